@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// KeySet holds the keys JWTs are signed and verified with. Every token carries
+// the id of its key in the kid header, so keys retired from signing keep
+// verifying the tokens they issued until those expire.
+type KeySet struct {
+	signKID string
+	keys    map[string]jwtKey
+}
+
+type jwtKey struct {
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]jwtKey)}
+}
+
+// AddSecret adds a HS256 shared secret
+func (k *KeySet) AddSecret(kid string, secret []byte) error {
+	if kid == "" || len(secret) == 0 {
+		return fmt.Errorf("jwt secret %q: empty key id or secret", kid)
+	}
+	if _, ok := k.keys[kid]; ok {
+		return fmt.Errorf("jwt key %q is set twice", kid)
+	}
+	k.keys[kid] = jwtKey{method: jwt.SigningMethodHS256, private: secret, public: secret}
+	return nil
+}
+
+// AddPrivateKeyPEM adds a RSA (RS256) or Ed25519 (EdDSA) private key
+func (k *KeySet) AddPrivateKeyPEM(kid string, data []byte) error {
+	if kid == "" {
+		return fmt.Errorf("jwt private key: empty key id")
+	}
+	if _, ok := k.keys[kid]; ok {
+		return fmt.Errorf("jwt key %q is set twice", kid)
+	}
+
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		k.keys[kid] = jwtKey{method: jwt.SigningMethodRS256, private: rsaKey, public: &rsaKey.PublicKey}
+		return nil
+	}
+
+	edKey, err := jwt.ParseEdPrivateKeyFromPEM(data)
+	if err != nil {
+		return fmt.Errorf("jwt key %q is neither RSA nor Ed25519 private key", kid)
+	}
+	priv, ok := edKey.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("jwt key %q is not Ed25519 private key", kid)
+	}
+	k.keys[kid] = jwtKey{method: jwt.SigningMethodEdDSA, private: priv, public: priv.Public()}
+	return nil
+}
+
+// SetSigningKey selects the key new tokens are signed with
+func (k *KeySet) SetSigningKey(kid string) error {
+	if _, ok := k.keys[kid]; !ok {
+		return fmt.Errorf("jwt signing key %q is not loaded", kid)
+	}
+	k.signKID = kid
+	return nil
+}
+
+// SigningKey returns the id of the key new tokens are signed with
+func (k *KeySet) SigningKey() string {
+	return k.signKID
+}
+
+// Sign signs the claims with the signing key and puts its id into the kid header
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key, ok := k.keys[k.signKID]
+	if !ok {
+		return "", fmt.Errorf("jwt signing key is not set")
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = k.signKID
+	return token.SignedString(key.private)
+}
+
+// Keyfunc picks the verification key by the kid header and makes sure
+// the token algorithm is the one of that key
+func (k *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public halves of the asymmetric keys, shared secrets are never exposed
+func (k *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for kid, key := range k.keys {
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "OKP",
+				Kid: kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
+
+// LoadSecretsFile reads kid:secret pairs, one per line, empty lines and # comments are skipped
+func LoadSecretsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jwt secrets file: %w", err)
+	}
+
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kid, secret, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("jwt secrets file %s:%d: expected kid:secret", path, n)
+		}
+		if _, ok := secrets[kid]; ok {
+			return nil, fmt.Errorf("jwt secrets file %s:%d: key %q is set twice", path, n, kid)
+		}
+		secrets[kid] = secret
+	}
+	return secrets, scanner.Err()
+}
@@ -0,0 +1,28 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSecretsFile(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "secrets")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	secrets, err := LoadSecretsFile(write(t, "# keys\nold:s3cret\n\nnew:with:colon\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"old": "s3cret", "new": "with:colon"}, secrets)
+
+	_, err = LoadSecretsFile(write(t, "a:1\nb:2\na:3\n"))
+	assert.ErrorContains(t, err, `key "a" is set twice`)
+
+	_, err = LoadSecretsFile(write(t, "no separator\n"))
+	assert.ErrorContains(t, err, "expected kid:secret")
+}
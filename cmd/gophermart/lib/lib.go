@@ -2,8 +2,12 @@ package lib
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"math"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -11,22 +15,25 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var secret = "PaBjK!7K$&qMUMTb"
-
 type JWTClaims struct {
 	jwt.RegisteredClaims
-	UserID uuid.UUID `json:"user_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	SessionID uuid.UUID `json:"sid"`
+	MFA       bool      `json:"mfa,omitempty"` // password checked, second factor pending
 }
 
-func CreateJWT(userUUID uuid.UUID) (string, error) {
+func CreateJWT(keys *KeySet, userUUID, sessionID uuid.UUID, ttl time.Duration) (string, error) {
+	now := time.Now()
 	claims := JWTClaims{
-		UserID: userUUID,
+		UserID:    userUUID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	jwtString, err := token.SignedString([]byte(secret))
+	jwtString, err := keys.Sign(claims)
 	if err != nil {
 		return "", err
 	}
@@ -34,23 +41,57 @@ func CreateJWT(userUUID uuid.UUID) (string, error) {
 	return jwtString, nil
 }
 
-func CheckJWT(tokenString string) (uuid.UUID, error) {
-	claims := JWTClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
+// CreateMFAJWT issues the partial token a login with 2FA gets after the password check,
+// it is only good for exchanging with a second factor code
+func CreateMFAJWT(keys *KeySet, userUUID uuid.UUID, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return keys.Sign(JWTClaims{
+		UserID: userUUID,
+		MFA:    true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
 	})
+}
+
+func CheckJWT(keys *KeySet, tokenString string) (JWTClaims, error) {
+	claims := JWTClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, keys.Keyfunc)
 	if err != nil {
-		return uuid.Nil, err
+		return JWTClaims{}, err
 	}
 
 	if !token.Valid {
-		return uuid.Nil, err
+		return JWTClaims{}, fmt.Errorf("invalid token")
 	}
 
-	return claims.UserID, nil
+	return claims, nil
+}
+
+// NewOpaqueToken returns a random opaque token (refresh, password reset) and the hash to store instead of it
+func NewOpaqueToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex sha256 of an opaque token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyedHash returns the hex HMAC-SHA256 of value, it identifies a value without
+// revealing it to anyone who does not hold the key
+func KeyedHash(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func CalculateLuhn(number int64) int64 {
@@ -93,8 +134,3 @@ func IsTableExist(p *pgxpool.Pool, table string) bool {
 
 	return err == nil
 }
-
-func RoundFloat(val float64, precision uint) float64 {
-	ratio := math.Pow(10, float64(precision))
-	return math.Round(val*ratio) / ratio
-}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks values sealed by SecretBox, anything else is stored as is
+const sealedPrefix = "v1:"
+
+// SecretBox encrypts short secrets kept in the database, like TOTP secrets,
+// with AES-256-GCM. A nil SecretBox stores and returns them unencrypted.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox makes a SecretBox of a 32 byte key
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret box key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// ParseSecretBoxKey decodes a base64 key, as given on the command line
+func ParseSecretBoxKey(s string) (*SecretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("secret box key is not base64: %w", err)
+	}
+	return NewSecretBox(key)
+}
+
+// Seal encrypts the secret bound to owner, a sealed value opened for
+// another owner fails, so secrets cannot be swapped between rows
+func (b *SecretBox) Seal(secret, owner string) (string, error) {
+	if b == nil {
+		return secret, nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(secret), []byte(owner))
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// IsSealed reports whether value was made by Seal
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Open decrypts a value of Seal. With a key set unsealed values are refused,
+// whoever can write the database must not be able to plant a known secret;
+// a nil SecretBox returns them as they are.
+func (b *SecretBox) Open(value, owner string) (string, error) {
+	if b == nil {
+		if IsSealed(value) {
+			return "", fmt.Errorf("secret is encrypted, but no key is set")
+		}
+		return value, nil
+	}
+	if !IsSealed(value) {
+		return "", fmt.Errorf("secret is not encrypted")
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil || len(data) < b.aead.NonceSize() {
+		return "", fmt.Errorf("sealed secret is malformed")
+	}
+	nonce, sealed := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	secret, err := b.aead.Open(nil, nonce, sealed, []byte(owner))
+	if err != nil {
+		return "", fmt.Errorf("cannot open sealed secret: %w", err)
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+
+	sealed, err := box.Seal(rfcSecret, "owner-1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, sealedPrefix))
+	assert.NotContains(t, sealed, rfcSecret)
+
+	again, err := box.Seal(rfcSecret, "owner-1")
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "every seal has a fresh nonce")
+
+	secret, err := box.Open(sealed, "owner-1")
+	require.NoError(t, err)
+	assert.Equal(t, rfcSecret, secret)
+
+	_, err = box.Open(sealed, "owner-2")
+	assert.Error(t, err, "sealed for another owner")
+
+	other, err := NewSecretBox(bytes.Repeat([]byte{8}, 32))
+	require.NoError(t, err)
+	_, err = other.Open(sealed, "owner-1")
+	assert.Error(t, err, "another key")
+
+	_, err = box.Open(sealedPrefix+"AAAA", "owner-1")
+	assert.Error(t, err, "truncated")
+
+	_, err = box.Open(rfcSecret, "owner-1")
+	assert.Error(t, err, "unsealed secrets are refused once a key is set")
+	assert.True(t, IsSealed(sealed))
+	assert.False(t, IsSealed(rfcSecret))
+}
+
+func TestSecretBoxNil(t *testing.T) {
+	var box *SecretBox
+
+	sealed, err := box.Seal(rfcSecret, "owner-1")
+	require.NoError(t, err)
+	assert.Equal(t, rfcSecret, sealed)
+
+	secret, err := box.Open(rfcSecret, "owner-1")
+	require.NoError(t, err)
+	assert.Equal(t, rfcSecret, secret)
+
+	_, err = box.Open(sealedPrefix+"AAAA", "owner-1")
+	assert.Error(t, err, "sealed secret without a key")
+}
+
+func TestParseSecretBoxKey(t *testing.T) {
+	_, err := ParseSecretBoxKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	assert.NoError(t, err)
+
+	_, err = ParseSecretBoxKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)))
+	assert.Error(t, err, "short key")
+
+	_, err = ParseSecretBoxKey("not base64!")
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA1 test key of RFC 4226 and RFC 6238, "12345678901234567890" in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC4226(t *testing.T) {
+	// RFC 4226 appendix D, HOTP values for counters 0..9
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := TOTPCode(rfcSecret, int64(counter))
+		require.NoError(t, err)
+		assert.Equal(t, code, got, "counter %d", counter)
+	}
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 rows; the RFC prints 8 digits, we use the last 6
+	tbl := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "94287082"},
+		{unix: 1111111109, code: "07081804"},
+		{unix: 1111111111, code: "14050471"},
+		{unix: 1234567890, code: "89005924"},
+		{unix: 2000000000, code: "69279037"},
+		{unix: 20000000000, code: "65353130"},
+	}
+	for _, tt := range tbl {
+		now := time.Unix(tt.unix, 0)
+		got, err := TOTPCode(rfcSecret, TOTPStep(now))
+		require.NoError(t, err)
+		assert.Equal(t, tt.code[2:], got, "time %d", tt.unix)
+
+		step, ok := ValidateTOTP(rfcSecret, tt.code[2:], now)
+		assert.True(t, ok)
+		assert.Equal(t, TOTPStep(now), step)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := TOTPStep(now)
+	code := func(step int64) string {
+		c, err := TOTPCode(rfcSecret, step)
+		require.NoError(t, err)
+		return c
+	}
+
+	got, ok := ValidateTOTP(rfcSecret, code(step-1), now)
+	assert.True(t, ok, "previous step is within skew")
+	assert.Equal(t, step-1, got)
+
+	got, ok = ValidateTOTP(rfcSecret, code(step+1), now)
+	assert.True(t, ok, "next step is within skew")
+	assert.Equal(t, step+1, got)
+
+	_, ok = ValidateTOTP(rfcSecret, code(step-2), now)
+	assert.False(t, ok, "two steps back is too old")
+	_, ok = ValidateTOTP(rfcSecret, code(step+2), now)
+	assert.False(t, ok, "two steps ahead is too early")
+
+	c := code(step)
+	_, ok = ValidateTOTP(rfcSecret, " "+c[:3]+" "+c[3:]+" ", now)
+	assert.True(t, ok, "spaces are ignored")
+	_, ok = ValidateTOTP(rfcSecret, c[:5], now)
+	assert.False(t, ok, "short code")
+	_, ok = ValidateTOTP(strings.ToLower(rfcSecret), c, now)
+	assert.True(t, ok, "lower case secret")
+	_, ok = ValidateTOTP("not base32!", c, now)
+	assert.False(t, ok, "bad secret")
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	a, err := NewTOTPSecret()
+	require.NoError(t, err)
+	b, err := NewTOTPSecret()
+	require.NoError(t, err)
+	assert.Len(t, a, 32, "160 bits in unpadded base32")
+	assert.NotEqual(t, a, b)
+
+	_, err = TOTPCode(a, 1)
+	assert.NoError(t, err)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+
+	seen := map[string]bool{}
+	for _, c := range codes {
+		assert.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, c)
+		assert.False(t, seen[c], "codes are unique")
+		seen[c] = true
+		assert.Equal(t, c, NormalizeRecoveryCode(" "+strings.ToUpper(c)+" "))
+	}
+}
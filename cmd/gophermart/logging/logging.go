@@ -0,0 +1,116 @@
+// Package logging sets up the structured logger. Every line carries the request
+// ID, user and trace of the context it is logged with, secrets are masked.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config picks the output format, "text" or "json", and the lowest level logged
+type Config struct {
+	Format string
+	Level  string // debug, info, warn or error
+	Source bool   // add the file and line of the caller
+}
+
+// Setup makes the logger of cfg the default one for slog and the standard log package
+func Setup(w io.Writer, cfg Config) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource:   cfg.Source,
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}
+	var h slog.Handler
+	switch cfg.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+
+	logger := slog.New(contextHandler{h})
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+type scopeKey struct{}
+
+// scope holds the attrs added to a context after it was created, so that
+// middlewares up the chain see what handlers down the chain learned
+type scope struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// WithScope returns ctx with an empty scope, attrs added to it with Add go to
+// every line logged with ctx or a context derived from it
+func WithScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scopeKey{}, &scope{})
+}
+
+// Add attaches attrs to the scope of ctx, nothing happens if ctx has none
+func Add(ctx context.Context, attrs ...slog.Attr) {
+	sc, ok := ctx.Value(scopeKey{}).(*scope)
+	if !ok {
+		return
+	}
+	sc.mu.Lock()
+	sc.attrs = append(sc.attrs, attrs...)
+	sc.mu.Unlock()
+}
+
+// contextHandler adds the scope attrs and the trace ID of the context to the record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc, ok := ctx.Value(scopeKey{}).(*scope); ok {
+		sc.mu.Lock()
+		r.AddAttrs(sc.attrs...)
+		sc.mu.Unlock()
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Printf adapts the logger to libraries logging with printf lines at a single level
+type Printf struct {
+	Logger *slog.Logger
+	Level  slog.Level
+}
+
+// Logf logs the formatted line, a "[LEVEL] " prefix is dropped
+func (p Printf) Logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if strings.HasPrefix(msg, "[") {
+		if i := strings.Index(msg, "] "); i > 0 {
+			msg = msg[i+2:]
+		}
+	}
+	p.Logger.Log(context.Background(), p.Level, msg)
+}
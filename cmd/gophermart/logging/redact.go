@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces the values of sensitive fields
+const Redacted = "[REDACTED]"
+
+// sensitive are the parts of field names whose values never go to the log
+var sensitive = []string{"password", "token", "secret", "authorization", "cookie", "csrf", "recovery"}
+
+// sensitiveExact are field names too short to be matched as parts
+var sensitiveExact = []string{"code", "otp", "totp"}
+
+// Sensitive reports whether values of the field must not be logged
+func Sensitive(field string) bool {
+	field = strings.ToLower(field)
+	for _, s := range sensitive {
+		if strings.Contains(field, s) {
+			return true
+		}
+	}
+	for _, s := range sensitiveExact {
+		if field == s {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindGroup && Sensitive(a.Key) {
+		a.Value = slog.StringValue(Redacted)
+	}
+	return a
+}
+
+// RedactBody masks sensitive fields of a JSON body at any depth,
+// bodies that are not JSON objects or arrays are returned as is
+func RedactBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return string(body)
+	}
+
+	data, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return string(body)
+	}
+	return string(data)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if Sensitive(k) {
+				v[k] = Redacted
+				continue
+			}
+			v[k] = redactValue(val)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+// RedactURL returns the path and query of u with sensitive query parameters masked
+func RedactURL(u *url.URL) string {
+	q := u.Query()
+	for k := range q {
+		if Sensitive(k) {
+			q[k] = []string{Redacted}
+		}
+	}
+	if len(q) == 0 {
+		return u.Path
+	}
+	return u.Path + "?" + q.Encode()
+}
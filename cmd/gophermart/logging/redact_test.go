@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSensitive(t *testing.T) {
+	for _, field := range []string{
+		"password", "new_password", "Authorization", "refresh_token", "X-CSRF-Token",
+		"totp_secret", "recovery_codes", "Cookie", "code", "OTP", "totp",
+	} {
+		assert.True(t, Sensitive(field), field)
+	}
+	for _, field := range []string{"login", "order", "sum", "zip_code", "status", "uid", ""} {
+		assert.False(t, Sensitive(field), field)
+	}
+}
+
+func TestRedactAttr(t *testing.T) {
+	tbl := []struct {
+		name   string
+		groups []string
+		attr   slog.Attr
+		want   slog.Value
+	}{
+		{name: "plain", attr: slog.String("login", "alice"), want: slog.StringValue("alice")},
+		{name: "token", attr: slog.String("token", "abc"), want: slog.StringValue(Redacted)},
+		{name: "not a string", attr: slog.Int("code", 123456), want: slog.StringValue(Redacted)},
+		{name: "in a group", groups: []string{"request"}, attr: slog.String("password", "x"), want: slog.StringValue(Redacted)},
+		{name: "any token key", attr: slog.String("local_only_token", "abc"), want: slog.StringValue(Redacted)},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactAttr(tt.groups, tt.attr)
+			assert.Equal(t, tt.attr.Key, got.Key)
+			assert.True(t, tt.want.Equal(got.Value), "got %v", got.Value)
+		})
+	}
+
+	// groups themselves are kept, their members are redacted one by one
+	group := slog.Group("secrets", slog.String("login", "alice"))
+	assert.True(t, group.Equal(redactAttr(nil, group)))
+}
+
+func TestSetupRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := Setup(&buf, Config{Format: "json", Level: "info"})
+	require.NoError(t, err)
+	defer slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+
+	logger.InfoContext(context.Background(), "reset",
+		"login", "alice", "token", "t1", "reset_token", "t2", slog.Group("req", slog.String("password", "p1")))
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "alice", line["login"])
+	assert.Equal(t, Redacted, line["token"])
+	assert.Equal(t, Redacted, line["reset_token"])
+	assert.NotContains(t, buf.String(), "t1")
+	assert.NotContains(t, buf.String(), "t2")
+	assert.Equal(t, map[string]interface{}{"password": Redacted}, line["req"])
+}
+
+func TestRedactBody(t *testing.T) {
+	tbl := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "flat",
+			body: `{"login":"alice","password":"Secret123"}`,
+			want: `{"login":"alice","password":"[REDACTED]"}`,
+		},
+		{
+			name: "nested",
+			body: `{"user":{"login":"alice","new_password":"x"},"codes":[{"code":"123456","n":1}]}`,
+			want: `{"user":{"login":"alice","new_password":"[REDACTED]"},"codes":[{"code":"[REDACTED]","n":1}]}`,
+		},
+		{
+			name: "sensitive object replaced whole",
+			body: `{"recovery":{"codes":["a","b"]},"order":"12345678903"}`,
+			want: `{"recovery":"[REDACTED]","order":"12345678903"}`,
+		},
+		{name: "array", body: `[{"token":"t"},"plain"]`, want: `[{"token":"[REDACTED]"},"plain"]`},
+		{name: "not json", body: `12345678903`, want: `12345678903`},
+		{name: "json scalar", body: `"password"`, want: `"password"`},
+		{name: "broken json", body: `{"password":`, want: `{"password":`},
+		{name: "empty", body: ``, want: ``},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RedactBody([]byte(tt.body))
+			if json.Valid([]byte(tt.want)) && tt.want != "" {
+				assert.JSONEq(t, tt.want, got)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tbl := []struct {
+		url  string
+		want string
+	}{
+		{url: "/api/user/orders", want: "/api/user/orders"},
+		{url: "/api/user/orders?limit=10&offset=20", want: "/api/user/orders?limit=10&offset=20"},
+		{url: "/api/user/password/reset?token=abc&login=alice", want: "/api/user/password/reset?login=alice&token=%5BREDACTED%5D"},
+		{url: "/cb?access_token=a&access_token=b", want: "/cb?access_token=%5BREDACTED%5D"},
+		{url: "/cb?Code=123456", want: "/cb?Code=%5BREDACTED%5D"},
+		{url: "http://host:8080/path?x=1#frag", want: "/path?x=1"},
+	}
+	for _, tt := range tbl {
+		u, err := url.Parse(tt.url)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, RedactURL(u), tt.url)
+	}
+}
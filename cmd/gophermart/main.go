@@ -2,16 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	log "github.com/go-pkgz/lgr"
 	"github.com/umputun/go-flags"
 
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/logging"
+	"github.com/stsg/gophermart/cmd/gophermart/metrics"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/notify"
 	"github.com/stsg/gophermart/cmd/gophermart/server"
 	"github.com/stsg/gophermart/cmd/gophermart/service"
 	postgres "github.com/stsg/gophermart/cmd/gophermart/store"
+	"github.com/stsg/gophermart/cmd/gophermart/store/memory"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
 )
 
 var opts struct {
@@ -22,7 +34,61 @@ var opts struct {
 	RunAddr string `short:"a" long:"run-address" env:"RUN_ADDRESS" default:"localhost:8080" description:"server address"`
 	DBURI   string `short:"d" long:"database-uri" env:"DATABASE_URI" default:"" description:"database uri"`
 	AccAddr string `short:"r" long:"accrual-system-address" env:"ACCRUAL_SYSTEM_ADDRESS" default:"" description:"accrual system address"`
-	Dbg     bool   `long:"dbg" description:"debug mode"`
+	AccWrk  int    `short:"w" long:"accrual-workers" env:"ACCRUAL_WORKERS" default:"4" description:"accrual workers per stage"`
+	Dbg     bool   `long:"dbg" description:"debug mode, logs debug lines with their source"`
+
+	Log struct {
+		Format string `long:"format" env:"FORMAT" default:"text" choice:"text" choice:"json" description:"log output format"`
+		Level  string `long:"level" env:"LEVEL" default:"info" choice:"debug" choice:"info" choice:"warn" choice:"error" description:"lowest level logged"`
+	} `group:"log" namespace:"log" env-namespace:"LOG"`
+
+	JWT struct {
+		KID         string            `long:"kid" env:"KID" description:"id of the key new tokens are signed with"`
+		Secrets     map[string]string `long:"secret" env:"SECRETS" env-delim:"," description:"HS256 secret as kid:secret, repeatable"`
+		SecretsFile string            `long:"secrets-file" env:"SECRETS_FILE" description:"file with kid:secret lines"`
+		Keys        map[string]string `long:"key" env:"KEYS" env-delim:"," description:"RSA or Ed25519 PEM private key file as kid:path, repeatable"`
+		AccessTTL   time.Duration     `long:"access-ttl" env:"ACCESS_TTL" default:"15m" description:"access token lifetime"`
+		RefreshTTL  time.Duration     `long:"refresh-ttl" env:"REFRESH_TTL" default:"720h" description:"refresh token lifetime"`
+	} `group:"jwt" namespace:"jwt" env-namespace:"JWT"`
+
+	Login struct {
+		MaxFailures int           `long:"max-failures" env:"MAX_FAILURES" default:"5" description:"failed logins before lockout, 0 disables"`
+		Window      time.Duration `long:"window" env:"WINDOW" default:"15m" description:"failed logins sliding window"`
+		Lockout     time.Duration `long:"lockout" env:"LOCKOUT" default:"1m" description:"first lockout duration, doubled on each next one"`
+		MaxLockout  time.Duration `long:"max-lockout" env:"MAX_LOCKOUT" default:"1h" description:"lockout duration limit"`
+	} `group:"login" namespace:"login" env-namespace:"LOGIN"`
+
+	Policy struct {
+		LoginMinLen     int           `long:"login-min-len" env:"LOGIN_MIN_LEN" default:"3" description:"login min length"`
+		LoginMaxLen     int           `long:"login-max-len" env:"LOGIN_MAX_LEN" default:"64" description:"login max length"`
+		PasswordMinLen  int           `long:"password-min-len" env:"PASSWORD_MIN_LEN" default:"8" description:"password min length"`
+		PasswordClasses int           `long:"password-classes" env:"PASSWORD_CLASSES" default:"2" description:"character classes a password mixes at least"`
+		BreachedFile    string        `long:"breached-passwords" env:"BREACHED_PASSWORDS" description:"file with leaked passwords, one per line"`
+		BcryptCost      int           `long:"bcrypt-cost" env:"BCRYPT_COST" default:"10" description:"password hash cost, weaker hashes are upgraded on login"`
+		ResetTTL        time.Duration `long:"reset-ttl" env:"RESET_TTL" default:"30m" description:"password reset token lifetime"`
+	} `group:"policy" namespace:"policy" env-namespace:"POLICY"`
+
+	Notify     string        `long:"notify" env:"NOTIFY" choice:"file" choice:"log" description:"where user notifications go, log only records them without tokens and is for development; required with a database unless --notify-file is set"`
+	NotifyFile string        `long:"notify-file" env:"NOTIFY_FILE" description:"file to write user notifications to"`
+	Retention  time.Duration `long:"retention" env:"RETENTION" default:"720h" description:"how long deleted accounts keep their login before anonymization"`
+	TOTPKey    string        `long:"totp-key" env:"TOTP_KEY" description:"base64 32 byte key TOTP secrets are encrypted with in the database, required with a database"`
+	AuditKey   string        `long:"audit-key" env:"AUDIT_KEY" description:"base64 key failed logins are hashed with in the audit log, random if not set"`
+	Admins     []string      `long:"admin-login" env:"ADMIN_LOGINS" env-delim:"," description:"registered login granted the admin role on startup while there is no admin, repeatable"`
+	Drain      time.Duration `long:"drain-timeout" env:"DRAIN_TIMEOUT" default:"20s" description:"how long in-flight requests and accrual jobs may finish on shutdown"`
+	DrainDelay time.Duration `long:"drain-delay" env:"DRAIN_DELAY" default:"0s" description:"how long readiness fails on shutdown before new connections are refused"`
+
+	Health struct {
+		AccrualStale time.Duration `long:"accrual-stale" env:"ACCRUAL_STALE" default:"5m" description:"not ready if orders wait and no accrual call succeeded for this long, 0 disables"`
+		MaxQueue     int           `long:"max-queue" env:"MAX_QUEUE" default:"10000" description:"not ready if more orders wait for accrual, 0 disables"`
+	} `group:"health" namespace:"health" env-namespace:"HEALTH"`
+
+	Trace struct {
+		Exporter string  `long:"exporter" env:"EXPORTER" default:"none" choice:"none" choice:"stdout" choice:"file" choice:"otlp" description:"where spans go"`
+		Endpoint string  `long:"endpoint" env:"ENDPOINT" description:"OTLP/HTTP collector host:port"`
+		Insecure bool    `long:"insecure" env:"INSECURE" description:"plain http to the collector"`
+		File     string  `long:"file" env:"FILE" default:"spans.json" description:"file the file exporter appends spans to"`
+		Ratio    float64 `long:"ratio" env:"RATIO" default:"1" description:"share of new traces recorded"`
+	} `group:"trace" namespace:"trace" env-namespace:"TRACE"`
 }
 
 var revision = "prototype-0.1.0"
@@ -33,44 +99,324 @@ func main() {
 	}
 	fmt.Printf("gophermart %s\n", revision)
 
-	setupLog(opts.Dbg)
+	if err := setupLog(); err != nil {
+		fmt.Fprintf(os.Stderr, "log setup error: %s\n", err)
+		os.Exit(1)
+	}
 
-	pCfg := &postgres.Config{
-		ConnectionString: opts.DBURI,
-		ConnectTimeout:   1 * time.Second,
-		QueryTimeout:     1 * time.Second,
-		MigrationVersion: 1,
+	traceShutdown, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    opts.Trace.Exporter,
+		Endpoint:    opts.Trace.Endpoint,
+		Insecure:    opts.Trace.Insecure,
+		File:        opts.Trace.File,
+		SampleRatio: opts.Trace.Ratio,
+		Version:     revision,
+	})
+	if err != nil {
+		slog.Error("tracing setup error", "err", err)
+		os.Exit(1)
+	}
+
+	storage, err := setupStorage(opts.DBURI)
+	if err != nil {
+		slog.Error("DB connection error", "err", err)
+		os.Exit(1)
 	}
 
-	storage, err := postgres.New(pCfg)
+	keys, err := setupKeys()
 	if err != nil {
-		log.Printf("[ERROR] DB connection error: %s", err)
+		slog.Error("JWT keys error", "err", err)
 		os.Exit(1)
 	}
 
-	srvc := service.New(storage, opts.AccAddr)
-	go srvc.SendToAccrual(context.Background())
-	go srvc.RecieveFromAccrual(context.Background())
-	go srvc.ProcessOrders(context.Background())
+	totpBox, err := setupTOTPBox()
+	if err != nil {
+		slog.Error("TOTP key error", "err", err)
+		os.Exit(1)
+	}
+
+	auditKey, err := setupAuditKey()
+	if err != nil {
+		slog.Error("audit key error", "err", err)
+		os.Exit(1)
+	}
+
+	notifier, err := setupNotifier()
+	if err != nil {
+		slog.Error("notifier error", "err", err)
+		os.Exit(1)
+	}
+
+	policy, err := setupPolicy()
+	if err != nil {
+		slog.Error("validation policy error", "err", err)
+		os.Exit(1)
+	}
+
+	srvc := service.New(storage, &service.Config{
+		AccrualAddress: opts.AccAddr,
+		AccrualWorkers: opts.AccWrk,
+		Keys:           keys,
+		TOTPBox:        totpBox,
+		AuditKey:       auditKey,
+		AccessTTL:      opts.JWT.AccessTTL,
+		RefreshTTL:     opts.JWT.RefreshTTL,
+		LoginLimits: service.LoginLimits{
+			MaxFailures: opts.Login.MaxFailures,
+			Window:      opts.Login.Window,
+			Lockout:     opts.Login.Lockout,
+			MaxLockout:  opts.Login.MaxLockout,
+		},
+		Policy:     policy,
+		BcryptCost: opts.Policy.BcryptCost,
+		ResetTTL:   opts.Policy.ResetTTL,
+		Notifier:   notifier,
+		Retention:  opts.Retention,
+		HealthLimits: service.HealthLimits{
+			AccrualStale: opts.Health.AccrualStale,
+			MaxQueue:     opts.Health.MaxQueue,
+		},
+	})
+	sealed, err := srvc.SealTOTPSecrets(context.Background())
+	if err != nil {
+		slog.Error("cannot encrypt TOTP secrets", "err", err)
+		os.Exit(1)
+	}
+	if sealed > 0 {
+		slog.Info("encrypted TOTP secrets stored before the key was set", "count", sealed)
+	}
+	if err := srvc.BootstrapAdmins(context.Background(), opts.Admins); err != nil {
+		slog.Error("cannot grant admin role", "err", err)
+		os.Exit(1)
+	}
+
+	metrics.RegisterStats(srvc.Stats)
+	if pool, ok := storage.(interface{ PoolStats() models.PoolStats }); ok {
+		metrics.RegisterPool(pool.PoolStats)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal kills the process right away
+		stop()
+		slog.Info("shutdown requested")
+	}()
 
 	srv := server.Server{
-		RunAddr: opts.RunAddr,
-		AccAddr: opts.AccAddr,
-		Service: srvc,
+		RunAddr:      opts.RunAddr,
+		AccAddr:      opts.AccAddr,
+		Service:      srvc,
+		DrainTimeout: opts.Drain,
+		DrainDelay:   opts.DrainDelay,
 	}
 
-	if err := srv.Run(context.Background()); err != nil {
-		log.Printf("[ERROR] server failed, %v", err)
+	err = run(ctx, stop, srv.Run, srvc.RunWorkers, storage, opts.Drain)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if terr := traceShutdown(flushCtx); terr != nil {
+		slog.Warn("cannot flush spans", "err", terr)
+	}
+	cancel()
+
+	if err != nil {
 		os.Exit(1)
 	}
+	slog.Info("gophermart stopped")
+}
+
+// run serves and runs the workers until ctx is done, then closes the storage once
+// both have stopped, so that neither in-flight requests nor accrual jobs lose the
+// database halfway. Workers still busy after drain are abandoned, their jobs stay
+// queued. A failing server calls stop to bring the workers down too.
+func run(ctx context.Context, stop func(), serve func(context.Context) error, workers func(context.Context),
+	storage service.Storage, drain time.Duration) error {
+	workersDone := make(chan struct{})
+	go func() {
+		defer close(workersDone)
+		workers(ctx)
+	}()
+
+	err := serve(ctx)
+	if err != nil {
+		slog.Error("server failed", "err", err)
+		stop()
+	}
+
+	select {
+	case <-workersDone:
+	case <-time.After(drain):
+		slog.Warn("workers did not stop, unfinished accrual jobs stay queued", "timeout", drain)
+	}
+	storage.Close()
+	return err
+}
+
+// setupStorage connects to PostgreSQL, or falls back to in-memory storage when no uri is set
+func setupStorage(dbURI string) (service.Storage, error) {
+	if dbURI == "" {
+		slog.Warn("database uri is not set, using in-memory storage")
+		return memory.New(), nil
+	}
+
+	pCfg := &postgres.Config{
+		ConnectionString: dbURI,
+		ConnectTimeout:   1 * time.Second,
+		QueryTimeout:     1 * time.Second,
+		MigrationVersion: 16,
+	}
+
+	return postgres.New(pCfg)
+}
+
+// setupNotifier picks where password reset tokens go, there is no real delivery yet.
+// The log notifier never writes the tokens out and has to be asked for with a
+// database; only in-memory storage falls back to it.
+func setupNotifier() (service.Notifier, error) {
+	switch {
+	case opts.Notify == "log" && opts.NotifyFile != "":
+		return nil, fmt.Errorf("--notify=log conflicts with --notify-file")
+	case opts.Notify == "log":
+		slog.Warn("log notifier configured, password reset tokens are not delivered, for development only")
+		return notify.Log{}, nil
+	case opts.NotifyFile != "":
+		return notify.NewFile(opts.NotifyFile), nil
+	case opts.Notify == "file":
+		return nil, fmt.Errorf("notify file is not set, set --notify-file")
+	case opts.DBURI != "":
+		return nil, fmt.Errorf("no notifier configured with a database, set --notify-file or --notify=log")
+	}
+	slog.Warn("no notifier configured, password reset tokens are not delivered")
+	return notify.Log{}, nil
+}
+
+func setupPolicy() (service.Policy, error) {
+	policy := service.Policy{
+		LoginMinLen:     opts.Policy.LoginMinLen,
+		LoginMaxLen:     opts.Policy.LoginMaxLen,
+		PasswordMinLen:  opts.Policy.PasswordMinLen,
+		PasswordClasses: opts.Policy.PasswordClasses,
+	}
+	if opts.Policy.BreachedFile == "" {
+		return policy, nil
+	}
 
+	breached, err := service.LoadBreachedPasswords(opts.Policy.BreachedFile)
+	if err != nil {
+		return policy, err
+	}
+	slog.Info("breached passwords loaded", "count", len(breached))
+	policy.BreachedPassword = breached
+	return policy, nil
+}
+
+// setupTOTPBox makes the box TOTP secrets are encrypted with. The key is required
+// with a database, a dump of plain secrets would let anyone generate the codes;
+// in-memory storage keeps them as is.
+func setupTOTPBox() (*lib.SecretBox, error) {
+	if opts.TOTPKey == "" {
+		if opts.DBURI != "" {
+			return nil, fmt.Errorf("TOTP key is required with a database, set --totp-key")
+		}
+		return nil, nil
+	}
+	return lib.ParseSecretBoxKey(opts.TOTPKey)
+}
+
+// setupAuditKey decodes the key failed logins on unknown accounts are hashed
+// with in the audit log. Without it the hashes of one run cannot be matched
+// with those of another.
+func setupAuditKey() ([]byte, error) {
+	if opts.AuditKey == "" {
+		slog.Warn("no audit key configured, login hashes in the audit log will not match across restarts")
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(opts.AuditKey))
+	if err != nil {
+		return nil, fmt.Errorf("audit key is not base64: %w", err)
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("audit key must be at least 16 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// setupKeys loads JWT keys from flags, env and the secrets file. Without any key
+// a random secret is generated, so tokens do not survive a restart.
+func setupKeys() (*lib.KeySet, error) {
+	keys := lib.NewKeySet()
+
+	secrets := make(map[string]string, len(opts.JWT.Secrets))
+	for kid, secret := range opts.JWT.Secrets {
+		secrets[kid] = secret
+	}
+	if opts.JWT.SecretsFile != "" {
+		fileSecrets, err := lib.LoadSecretsFile(opts.JWT.SecretsFile)
+		if err != nil {
+			return nil, err
+		}
+		for kid, secret := range fileSecrets {
+			if _, ok := secrets[kid]; ok {
+				return nil, fmt.Errorf("jwt key %q is set both by --jwt.secret and in %s", kid, opts.JWT.SecretsFile)
+			}
+			secrets[kid] = secret
+		}
+	}
+
+	for kid, secret := range secrets {
+		if err := keys.AddSecret(kid, []byte(secret)); err != nil {
+			return nil, err
+		}
+	}
+
+	for kid, path := range opts.JWT.Keys {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read jwt key %s: %w", kid, err)
+		}
+		if err := keys.AddPrivateKeyPEM(kid, data); err != nil {
+			return nil, err
+		}
+	}
+
+	kid := opts.JWT.KID
+	switch {
+	case len(secrets)+len(opts.JWT.Keys) == 0:
+		slog.Warn("no JWT keys configured, using a random secret, tokens will not survive restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		kid = "ephemeral"
+		if err := keys.AddSecret(kid, secret); err != nil {
+			return nil, err
+		}
+	case kid == "" && len(secrets)+len(opts.JWT.Keys) == 1:
+		for k := range secrets {
+			kid = k
+		}
+		for k := range opts.JWT.Keys {
+			kid = k
+		}
+	case kid == "":
+		return nil, fmt.Errorf("several JWT keys configured, set --jwt.kid to pick the signing one")
+	}
+
+	if err := keys.SetSigningKey(kid); err != nil {
+		return nil, err
+	}
+	slog.Info("JWT tokens are signed", "kid", kid)
+	return keys, nil
 }
 
-func setupLog(dbg bool) {
-	if dbg {
-		log.Setup(log.Debug, log.CallerFile, log.Msec, log.LevelBraces)
-		return
+// setupLog makes the structured logger the default one, --dbg lowers the level to debug
+func setupLog() error {
+	cfg := logging.Config{Format: opts.Log.Format, Level: opts.Log.Level}
+	if opts.Dbg {
+		cfg.Level = "debug"
+		cfg.Source = true
 	}
-	// log.Setup(log.Msec, log.LevelBraces)
-	log.Setup(log.Debug, log.CallerFile, log.Msec, log.LevelBraces)
+	_, err := logging.Setup(os.Stdout, cfg)
+	return err
 }
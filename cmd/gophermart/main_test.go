@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/notify"
+	"github.com/stsg/gophermart/cmd/gophermart/server"
+	"github.com/stsg/gophermart/cmd/gophermart/service"
+	"github.com/stsg/gophermart/cmd/gophermart/store/memory"
+)
+
+// shutdownStorage holds the first Ping until released, so a readiness request
+// stays in flight, and records when it was closed
+type shutdownStorage struct {
+	service.Storage
+	pinged        atomic.Bool
+	entered       chan struct{}
+	release       chan struct{}
+	closed        atomic.Bool
+	workersExited *atomic.Bool
+	closedEarly   atomic.Bool
+}
+
+func (s *shutdownStorage) Ping(ctx context.Context) error {
+	if s.pinged.CompareAndSwap(false, true) {
+		close(s.entered)
+		<-s.release
+	}
+	return s.Storage.Ping(ctx)
+}
+
+func (s *shutdownStorage) Close() {
+	if !s.workersExited.Load() {
+		s.closedEarly.Store(true)
+	}
+	s.closed.Store(true)
+	s.Storage.Close()
+}
+
+func TestRunShutdown(t *testing.T) {
+	var workersExited atomic.Bool
+	storage := &shutdownStorage{
+		Storage:       memory.New(),
+		entered:       make(chan struct{}),
+		release:       make(chan struct{}),
+		workersExited: &workersExited,
+	}
+	srvc := service.New(storage, &service.Config{AccrualAddress: "http://127.0.0.1:1"})
+
+	const drainDelay = 300 * time.Millisecond
+	srv := server.Server{Service: srvc, DrainTimeout: 5 * time.Second, DrainDelay: drainDelay}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	url := "http://" + addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		workers := func(ctx context.Context) {
+			srvc.RunWorkers(ctx)
+			workersExited.Store(true)
+		}
+		serve := func(ctx context.Context) error { return srv.Serve(ctx, ln) }
+		done <- run(ctx, cancel, serve, workers, storage, 5*time.Second)
+	}()
+
+	fresh := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	resp, err := fresh.Get(url + "/health/live")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	type result struct {
+		code   int
+		health models.HealthResponse
+		err    error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		resp, err := fresh.Get(url + "/health/ready")
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var health models.HealthResponse
+		err = json.NewDecoder(resp.Body).Decode(&health)
+		inflight <- result{code: resp.StatusCode, health: health, err: err}
+	}()
+	<-storage.entered
+
+	start := time.Now()
+	cancel()
+
+	// readiness fails at once while the listener is still open
+	var draining models.HealthResponse
+	require.Eventually(t, func() bool {
+		resp, err := fresh.Get(url + "/health/ready")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			return false
+		}
+		return json.NewDecoder(resp.Body).Decode(&draining) == nil
+	}, drainDelay, 10*time.Millisecond)
+	assert.Equal(t, models.HealthFail, draining.Components["shutdown"].Status)
+	assert.Equal(t, "shutting down", draining.Components["shutdown"].Error)
+
+	// after the delay new connections are refused, the in-flight request holds the drain
+	require.Eventually(t, func() bool {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), drainDelay)
+	select {
+	case err := <-done:
+		t.Fatalf("run returned with a request in flight: %v", err)
+	default:
+	}
+	assert.False(t, storage.closed.Load(), "storage closed with a request in flight")
+
+	close(storage.release)
+	res := <-inflight
+	require.NoError(t, res.err, "in-flight request completes")
+	assert.Equal(t, http.StatusOK, res.code)
+	assert.Equal(t, models.HealthOK, res.health.Status)
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the drain")
+	}
+	assert.True(t, storage.closed.Load())
+	assert.False(t, storage.closedEarly.Load(), "accrual workers exit before storage closes")
+
+	_, err = net.DialTimeout("tcp", addr, 100*time.Millisecond)
+	var opErr *net.OpError
+	assert.True(t, errors.As(err, &opErr), "connection refused after the drain: %v", err)
+}
+
+func TestSetupNotifier(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+
+	tbl := []struct {
+		name   string
+		notify string
+		file   string
+		dbURI  string
+		want   service.Notifier
+		err    bool
+	}{
+		{name: "file", file: "n.jsonl", dbURI: "postgres://db", want: notify.NewFile("n.jsonl")},
+		{name: "file asked", notify: "file", file: "n.jsonl", want: notify.NewFile("n.jsonl")},
+		{name: "file asked without path", notify: "file", err: true},
+		{name: "log asked", notify: "log", dbURI: "postgres://db", want: notify.Log{}},
+		{name: "log and file", notify: "log", file: "n.jsonl", err: true},
+		{name: "database without notifier", dbURI: "postgres://db", err: true},
+		{name: "memory without notifier", want: notify.Log{}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			opts.Notify, opts.NotifyFile, opts.DBURI = tt.notify, tt.file, tt.dbURI
+			got, err := setupNotifier()
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
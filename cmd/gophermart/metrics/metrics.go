@@ -0,0 +1,162 @@
+// Package metrics exports gophermart numbers to Prometheus. Request and call
+// metrics are observed as they happen, the stored data is counted on scrape.
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+const (
+	namespace     = "gophermart"
+	scrapeTimeout = 2 * time.Second
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	accrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_requests_total",
+		Help:      "Requests to the accrual system by method and status code, \"error\" if no answer came.",
+	}, []string{"method", "code"})
+
+	accrualDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "accrual_request_duration_seconds",
+		Help:      "Accrual system request latency by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	bcryptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bcrypt_duration_seconds",
+		Help:      "Time spent hashing and comparing passwords.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"op"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveHTTP records a served request, route is the chi route pattern
+func ObserveHTTP(method, route string, code int, d time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(code)).Inc()
+	httpDuration.WithLabelValues(method, route).Observe(d.Seconds())
+}
+
+// ObserveAccrual records a call to the accrual system, code 0 means the call failed
+func ObserveAccrual(method string, code int, d time.Duration) {
+	label := "error"
+	if code > 0 {
+		label = strconv.Itoa(code)
+	}
+	accrualRequests.WithLabelValues(method, label).Inc()
+	accrualDuration.WithLabelValues(method).Observe(d.Seconds())
+}
+
+// ObserveBcrypt records a password hash ("hash") or check ("compare")
+func ObserveBcrypt(op string, d time.Duration) {
+	bcryptDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// StatsFunc counts the stored data
+type StatsFunc func(ctx context.Context) (models.Stats, error)
+
+// RegisterStats exports the accrual queues, orders by status and withdrawal totals
+func RegisterStats(stats StatsFunc) {
+	prometheus.MustRegister(&statsCollector{stats: stats})
+}
+
+var (
+	queueDepthDesc = prometheus.NewDesc(namespace+"_accrual_queue_depth",
+		"Orders waiting for the accrual system by stage, REGISTER is to and POLL is from accrual.", []string{"stage"}, nil)
+	ordersDesc = prometheus.NewDesc(namespace+"_orders",
+		"Orders by status.", []string{"status"}, nil)
+	withdrawalsDesc = prometheus.NewDesc(namespace+"_withdrawals_total",
+		"Withdrawals made.", nil, nil)
+	withdrawnDesc = prometheus.NewDesc(namespace+"_withdrawn_points_total",
+		"Points withdrawn.", nil, nil)
+)
+
+type statsCollector struct {
+	stats StatsFunc
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- ordersDesc
+	ch <- withdrawalsDesc
+	ch <- withdrawnDesc
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	stats, err := c.stats(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot collect stats", "err", err)
+		ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+		return
+	}
+
+	for _, stage := range []models.AccrualJobStage{models.AccrualJobRegister, models.AccrualJobPoll} {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(stats.QueueDepth[stage]), string(stage))
+	}
+	for _, status := range []models.AccrualStatus{
+		models.AccrualStatusNew, models.AccrualStatusProcessing, models.AccrualStatusInvalid, models.AccrualStatusProcessed,
+	} {
+		ch <- prometheus.MustNewConstMetric(ordersDesc, prometheus.GaugeValue, float64(stats.Orders[status]), string(status))
+	}
+	ch <- prometheus.MustNewConstMetric(withdrawalsDesc, prometheus.CounterValue, float64(stats.Withdrawals))
+	ch <- prometheus.MustNewConstMetric(withdrawnDesc, prometheus.CounterValue, stats.Withdrawn.Float64())
+}
+
+// RegisterPool exports the database connection pool usage
+func RegisterPool(stat func() models.PoolStats) {
+	gauge := func(name, help string, value func(models.PoolStats) float64) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "db_pool",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return value(stat()) })
+	}
+	gauge("acquired_connections", "Connections in use.", func(s models.PoolStats) float64 { return float64(s.Acquired) })
+	gauge("idle_connections", "Idle connections.", func(s models.PoolStats) float64 { return float64(s.Idle) })
+	gauge("total_connections", "Open connections.", func(s models.PoolStats) float64 { return float64(s.Total) })
+	gauge("max_connections", "Pool size limit.", func(s models.PoolStats) float64 { return float64(s.Max) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db_pool",
+		Name:      "empty_acquire_total",
+		Help:      "Acquires that had to wait for a connection.",
+	}, func() float64 { return float64(stat().EmptyAcquires) })
+}
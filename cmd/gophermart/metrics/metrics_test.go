@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestHandler(t *testing.T) {
+	RegisterStats(func(ctx context.Context) (models.Stats, error) {
+		return models.Stats{
+			QueueDepth: map[models.AccrualJobStage]int{models.AccrualJobRegister: 3, models.AccrualJobPoll: 5},
+			Orders: map[models.AccrualStatus]int{
+				models.AccrualStatusNew:       2,
+				models.AccrualStatusProcessed: 7,
+			},
+			Withdrawals: 4,
+			Withdrawn:   72998,
+		}, nil
+	})
+	RegisterPool(func() models.PoolStats {
+		return models.PoolStats{Acquired: 1, Idle: 2, Total: 3, Max: 10, EmptyAcquires: 6}
+	})
+	ObserveHTTP(http.MethodGet, "/api/user/orders", http.StatusOK, 10*time.Millisecond)
+	ObserveHTTP(http.MethodGet, "", http.StatusNotFound, time.Millisecond)
+	ObserveAccrual(http.MethodGet, 0, time.Second)
+
+	ts := httptest.NewServer(Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	body := string(data)
+
+	for _, line := range []string{
+		`gophermart_accrual_queue_depth{stage="REGISTER"} 3`,
+		`gophermart_accrual_queue_depth{stage="POLL"} 5`,
+		`gophermart_orders{status="NEW"} 2`,
+		`gophermart_orders{status="PROCESSED"} 7`,
+		`gophermart_orders{status="INVALID"} 0`,
+		`gophermart_withdrawals_total 4`,
+		`gophermart_withdrawn_points_total 729.98`,
+		`gophermart_db_pool_acquired_connections 1`,
+		`gophermart_db_pool_idle_connections 2`,
+		`gophermart_db_pool_total_connections 3`,
+		`gophermart_db_pool_max_connections 10`,
+		`gophermart_db_pool_empty_acquire_total 6`,
+		`gophermart_http_requests_total{code="200",method="GET",route="/api/user/orders"} 1`,
+		`gophermart_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`gophermart_accrual_requests_total{code="error",method="GET"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// audited actions
+const (
+	AuditUserRegister    = "user.register"
+	AuditUserRole        = "user.role"
+	AuditUserDelete      = "user.delete"
+	AuditLoginSuccess    = "login.success"
+	AuditLoginFailure    = "login.failure"
+	AuditLoginLockout    = "login.lockout"
+	AuditPasswordChange  = "password.change"
+	AuditPasswordReset   = "password.reset"
+	AuditTokenRevoke     = "token.revoke"
+	AuditOrderUpload     = "order.upload"
+	AuditOrderStatus     = "order.status"
+	AuditOrderRepoll     = "order.repoll"
+	AuditBalanceWithdraw = "balance.withdraw"
+	AuditBalanceAdjust   = "balance.adjust"
+)
+
+// SystemActor is the actor of changes gophermart makes by itself from its
+// configuration, like granting the admin role to the admin logins
+var SystemActor = uuid.Max
+
+// AuditEntry is an append-only record of who did what to whom. Before and After
+// hold the changed values, actions without an actor are done by gophermart itself.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Action    string          `json:"action"`
+	ActorUID  uuid.UUID       `json:"actor_uid"`
+	TargetUID uuid.UUID       `json:"target_uid"`
+	OrderID   string          `json:"order,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditQuery filters the audit log, zero fields match everything
+type AuditQuery struct {
+	Action    string
+	ActorUID  uuid.UUID
+	TargetUID uuid.UUID
+	OrderID   string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+// Match tells whether the entry passes the filter, paging aside
+func (q AuditQuery) Match(e AuditEntry) bool {
+	return (q.Action == "" || e.Action == q.Action) &&
+		(q.ActorUID == uuid.Nil || e.ActorUID == q.ActorUID) &&
+		(q.TargetUID == uuid.Nil || e.TargetUID == q.TargetUID) &&
+		(q.OrderID == "" || e.OrderID == q.OrderID) &&
+		(q.Since.IsZero() || !e.CreatedAt.Before(q.Since)) &&
+		(q.Until.IsZero() || e.CreatedAt.Before(q.Until))
+}
+
+// AuditMeta is what the audit log keeps about the request an action came with
+type AuditMeta struct {
+	IP        string
+	RequestID string
+}
+
+type auditMetaKey struct{}
+
+// WithAuditMeta returns the context carrying the request details for audit entries
+func WithAuditMeta(ctx context.Context, meta AuditMeta) context.Context {
+	return context.WithValue(ctx, auditMetaKey{}, meta)
+}
+
+// AuditMetaFrom returns the request details WithAuditMeta put in the context
+func AuditMetaFrom(ctx context.Context) AuditMeta {
+	meta, _ := ctx.Value(auditMetaKey{}).(AuditMeta)
+	return meta
+}
+
+// AuditValues marshals before/after values of an audit entry
+func AuditValues(v map[string]interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
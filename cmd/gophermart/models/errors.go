@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"time"
 )
 
 var (
@@ -10,11 +11,24 @@ var (
 	ErrUserUnauthorized  = fmt.Errorf("user unauthorized")
 	ErrUserWrong         = fmt.Errorf("user wrong")
 	ErrUserWrongPassword = fmt.Errorf("user password wrong")
+	ErrUserForbidden     = fmt.Errorf("user forbidden")
+	ErrRoleInvalid       = fmt.Errorf("role invalid")
+
+	ErrLoginLocked = fmt.Errorf("login locked")
+	ErrValidation  = fmt.Errorf("validation failed")
+
+	ErrTOTPEnabled     = fmt.Errorf("two-factor authentication already enabled")
+	ErrTOTPNotEnrolled = fmt.Errorf("two-factor authentication not enrolled")
+	ErrTOTPCodeInvalid = fmt.Errorf("two-factor code invalid")
+
+	ErrTokenInvalid = fmt.Errorf("token invalid")
+	ErrTokenRevoked = fmt.Errorf("token revoked")
 
 	ErrOrderNotFound           = fmt.Errorf("order not found")
 	ErrOrderExists             = fmt.Errorf("order exists")
 	ErrOrderBelongsAnotherUser = fmt.Errorf("order belongs to another user")
 	ErrOrderWrong              = fmt.Errorf("order wrong")
+	ErrOrderStatusTransition   = fmt.Errorf("order status transition not allowed")
 
 	ErrWithdrawalNotFound = fmt.Errorf("withdrawal not found")
 	ErrWithdrawalExists   = fmt.Errorf("withdrawal exists")
@@ -23,4 +37,40 @@ var (
 	ErrBalanceNotFound = fmt.Errorf("balance not found")
 	ErrBalanceExists   = fmt.Errorf("balance exists")
 	ErrBalanceWrong    = fmt.Errorf("balance wrong")
+
+	ErrJobNotFound = fmt.Errorf("accrual job not found")
 )
+
+// LockoutError is returned while a login or client address is locked out
+// after too many failed attempts, it matches ErrLoginLocked
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrLoginLocked, e.RetryAfter)
+}
+
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrLoginLocked
+}
+
+// Violation is a broken validation rule of a request field
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every rule the request broke, it matches ErrValidation
+type ValidationError struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s, %d rules broken", ErrValidation, len(e.Violations))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
@@ -10,16 +10,250 @@ type AccrualStatus string
 
 const (
 	AccrualStatusNew        AccrualStatus = "NEW"
+	AccrualStatusRegistered AccrualStatus = "REGISTERED" // reported by the accrual system only
 	AccrualStatusProcessing AccrualStatus = "PROCESSING"
 	AccrualStatusProcessed  AccrualStatus = "PROCESSED"
 	AccrualStatusInvalid    AccrualStatus = "INVALID"
 )
 
+// OrderStatus maps a status reported by the accrual system onto the order status,
+// returns an empty status for values the accrual system is not supposed to send
+func (s AccrualStatus) OrderStatus() AccrualStatus {
+	switch s {
+	case AccrualStatusRegistered, AccrualStatusProcessing:
+		return AccrualStatusProcessing
+	case AccrualStatusInvalid, AccrualStatusProcessed:
+		return s
+	}
+	return ""
+}
+
+// IsFinal tells whether the order status can not change anymore
+func (s AccrualStatus) IsFinal() bool {
+	return s == AccrualStatusProcessed || s == AccrualStatusInvalid
+}
+
+// CanTransit tells whether an order in status s may be moved to next:
+// NEW -> PROCESSING -> PROCESSED | INVALID, final statuses stay as they are
+func (s AccrualStatus) CanTransit(next AccrualStatus) bool {
+	switch s {
+	case AccrualStatusNew:
+		return next == AccrualStatusProcessing || next.IsFinal()
+	case AccrualStatusProcessing:
+		return next == AccrualStatusProcessing || next.IsFinal()
+	}
+	return false
+}
+
+// LedgerReason tells why the loyalty points moved
+type LedgerReason string
+
+const (
+	LedgerReasonAccrual    LedgerReason = "ACCRUAL"
+	LedgerReasonWithdrawal LedgerReason = "WITHDRAWAL"
+	LedgerReasonAdjustment LedgerReason = "ADJUSTMENT"
+)
+
+// Role decides what a user may do beyond their own account
+type Role string
+
+const (
+	RoleUser    Role = "user"
+	RoleSupport Role = "support" // reads any account, re-polls orders
+	RoleAdmin   Role = "admin"   // support plus balance adjustments and roles
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleSupport, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// AccrualJobStage is the step of talking to the accrual system an order waits for
+type AccrualJobStage string
+
+const (
+	AccrualJobRegister AccrualJobStage = "REGISTER"
+	AccrualJobPoll     AccrualJobStage = "POLL"
+)
+
 type User struct {
 	UID      uuid.UUID `json:"uuid,omitempty" db:"uuid"`
 	Login    string    `json:"login,omitempty" db:"login"`
 	PHash    string    `json:"p_hash,omitempty" db:"p_hash"`
 	JWTToken string    `json:"jwt_token,omitempty" db:"jwt_token"`
+	Role     Role      `json:"role,omitempty" db:"role"`
+}
+
+// UserSummary is a user as admins see them in search results
+type UserSummary struct {
+	UID     uuid.UUID `json:"uid"`
+	Login   string    `json:"login"`
+	Role    Role      `json:"role"`
+	Deleted bool      `json:"deleted"`
+}
+
+// Adjustment is a manual balance correction by an admin, Amount is signed
+type Adjustment struct {
+	ID        string    `json:"id"`
+	UID       uuid.UUID `json:"uid"`
+	ActorUID  uuid.UUID `json:"actor_uid"`
+	Amount    Money     `json:"amount"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AdjustmentRequest struct {
+	Amount Money  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type RoleRequest struct {
+	Role Role `json:"role"`
+}
+
+// Session is a login of a user, kept alive by a rotating refresh token.
+// Only hashes of refresh tokens are stored.
+type Session struct {
+	ID           uuid.UUID  `json:"id" db:"id"`
+	UID          uuid.UUID  `json:"uuid" db:"uid"`
+	RefreshHash  string     `json:"-" db:"refresh_hash"`
+	PreviousHash string     `json:"-" db:"previous_hash"`
+	ExpiresAt    time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+
+	RefreshExpiresIn int64 `json:"refresh_expires_in"`
+}
+
+// MFAResponse is the login answer for users with 2FA, MFAToken is exchanged
+// for a TokenResponse together with a TOTP or recovery code
+type MFAResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// TOTP is the second factor of a user, Enabled once the first code is verified.
+// LastStep is the time step of the last accepted code, codes are not accepted twice.
+type TOTP struct {
+	UID      uuid.UUID
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPVerifyResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// LoginLockout is the lockout state of a login or a client address,
+// Level counts the lockouts in a row and makes the next one longer
+type LoginLockout struct {
+	Key         string
+	Level       int
+	LockedUntil time.Time
+}
+
+// PasswordReset is a single-use password reset token, only its hash is stored
+type PasswordReset struct {
+	TokenHash string
+	UID       uuid.UUID
+	ExpiresAt time.Time
+}
+
+type PasswordChangeRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type UserDeleteRequest struct {
+	Password string `json:"password"`
+}
+
+// UserExport is everything gophermart keeps about the user
+type UserExport struct {
+	Profile        UserProfile           `json:"profile"`
+	Balance        BalanceResponse       `json:"balance"`
+	Orders         []OrderResponse       `json:"orders"`
+	Withdrawals    []WithdrawalsResponse `json:"withdrawals"`
+	BalanceHistory []LedgerEntryResponse `json:"balance_history"`
+	ExportedAt     time.Time             `json:"exported_at"`
+}
+
+type UserProfile struct {
+	UID       uuid.UUID `json:"uid"`
+	Login     string    `json:"login"`
+	TwoFactor bool      `json:"two_factor"`
+}
+
+// Stats are the counts of stored data exported as metrics
+type Stats struct {
+	QueueDepth  map[AccrualJobStage]int
+	Orders      map[AccrualStatus]int
+	Withdrawals int
+	Withdrawn   Money
+}
+
+// PoolStats is the usage of the database connection pool
+type PoolStats struct {
+	Acquired      int32
+	Idle          int32
+	Total         int32
+	Max           int32
+	EmptyAcquires int64
+}
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// HealthResponse is the readiness of gophermart with a breakdown per component
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+type ComponentHealth struct {
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	QueueDepth  *int       `json:"queue_depth,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 type UserRegisterRequest struct {
@@ -30,7 +264,7 @@ type UserRegisterRequest struct {
 type Order struct {
 	ID            string        `json:"number" db:"id"`
 	UID           uuid.UUID     `json:"uuid" db:"uuid"`
-	Amount        int64         `json:"accrual" db:"accrual"`
+	Amount        Money         `json:"accrual" db:"accrual"`
 	AccrualStatus AccrualStatus `json:"status" db:"accrual_status"`
 	UploadedAt    time.Time     `json:"uploaded_at" db:"uploaded_at"`
 }
@@ -38,48 +272,76 @@ type Order struct {
 type OrderResponse struct {
 	ID         string    `json:"number"`
 	Status     string    `json:"status"`
-	Amount     float64   `json:"accrual"`
+	Amount     Money     `json:"accrual"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
 type Accrual struct {
 	OrderID string    `json:"order" db:"order_id"`
 	UID     uuid.UUID `json:"uuid" db:"uid"`
-	Amount  int64     `json:"sum" db:"amount"`
+	Amount  Money     `json:"sum" db:"amount"`
 	// ProcessedAt time.Time `json:"processed_at" db:"processed_at"`
 }
 
 type AccrualResponse struct {
 	Order   string        `json:"order"`
 	Status  AccrualStatus `json:"status"`
-	Accrual float64       `json:"accrual"`
+	Accrual Money         `json:"accrual"`
+}
+
+type AccrualJob struct {
+	OrderID       string          `json:"order" db:"order_id"`
+	UID           uuid.UUID       `json:"uuid" db:"uid"`
+	Stage         AccrualJobStage `json:"stage" db:"stage"`
+	NextAttemptAt time.Time       `json:"next_attempt_at" db:"next_attempt_at"`
+	Attempts      int             `json:"attempts" db:"attempts"`
+	LastError     string          `json:"last_error,omitempty" db:"last_error"`
+	TraceParent   string          `json:"trace_parent,omitempty" db:"trace_parent"` // request that queued the job
 }
 
 type Balance struct {
 	UID       uuid.UUID `json:"uuid" db:"uid"`
-	Current   int       `json:"current" db:"current_balance"`
-	Withdrawn int       `json:"withdrawn" db:"withdrawn"`
+	Current   Money     `json:"current" db:"current_balance"`
+	Withdrawn Money     `json:"withdrawn" db:"withdrawn"`
 	// UploadedAt time.Time `json:"uploaded_at" db:"uploaded_at"`
 }
 
 type BalanceResponse struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   Money `json:"current"`
+	Withdrawn Money `json:"withdrawn"`
+}
+
+// LedgerEntry is an append-only record of a balance movement,
+// Amount is positive for credits and negative for debits
+type LedgerEntry struct {
+	ID        int64        `json:"id" db:"id"`
+	UID       uuid.UUID    `json:"uuid" db:"uid"`
+	OrderID   string       `json:"order" db:"order_id"`
+	Amount    Money        `json:"amount" db:"amount"`
+	Reason    LedgerReason `json:"reason" db:"reason"`
+	CreatedAt time.Time    `json:"created_at" db:"created_at"`
+}
+
+type LedgerEntryResponse struct {
+	Order     string       `json:"order"`
+	Amount    Money        `json:"amount"`
+	Reason    LedgerReason `json:"reason"`
+	CreatedAt time.Time    `json:"created_at"`
 }
 
 type WithdrawRequest struct {
-	Number  string  `json:"order"`
-	Accrual float64 `json:"sum"`
+	Number  string `json:"order"`
+	Accrual Money  `json:"sum"`
 }
 
 type WithdrawResponse struct {
 	Number      string    `json:"order"`
-	Accrual     float64   `json:"sum,omitempty"`
+	Accrual     Money     `json:"sum,omitempty"`
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
 type WithdrawalsResponse struct {
 	Number      string    `json:"order"`
-	Accrual     float64   `json:"sum,omitempty"`
+	Accrual     Money     `json:"sum,omitempty"`
 	ProcessedAt time.Time `json:"processed_at"`
 }
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccrualStatusCanTransit(t *testing.T) {
+	const (
+		nw  = AccrualStatusNew
+		reg = AccrualStatusRegistered
+		prc = AccrualStatusProcessing
+		ok  = AccrualStatusProcessed
+		inv = AccrualStatusInvalid
+	)
+	all := []AccrualStatus{nw, reg, prc, ok, inv}
+
+	// allowed lists every legal move, everything else must be refused
+	allowed := map[AccrualStatus][]AccrualStatus{
+		nw:  {prc, ok, inv},
+		reg: {},
+		prc: {prc, ok, inv},
+		ok:  {},
+		inv: {},
+	}
+
+	for _, from := range all {
+		for _, to := range all {
+			want := false
+			for _, a := range allowed[from] {
+				if a == to {
+					want = true
+				}
+			}
+			assert.Equal(t, want, from.CanTransit(to), "%s -> %s", from, to)
+		}
+	}
+
+	// unknown statuses never move and are never reached
+	assert.False(t, AccrualStatus("").CanTransit(prc))
+	assert.False(t, nw.CanTransit(AccrualStatus("DONE")))
+}
+
+func TestAccrualStatusIsFinal(t *testing.T) {
+	tbl := map[AccrualStatus]bool{
+		AccrualStatusNew:        false,
+		AccrualStatusRegistered: false,
+		AccrualStatusProcessing: false,
+		AccrualStatusProcessed:  true,
+		AccrualStatusInvalid:    true,
+	}
+	for s, want := range tbl {
+		assert.Equal(t, want, s.IsFinal(), s)
+	}
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount of loyalty points in minor units (kopecks).
+// It is marshalled to and from JSON as an exact decimal number like 729.98.
+type Money int64
+
+const moneyScale = 100
+
+// MoneyFromMinor makes Money from an amount in kopecks
+func MoneyFromMinor(minor int64) Money {
+	return Money(minor)
+}
+
+// Minor returns the amount in kopecks
+func (m Money) Minor() int64 {
+	return int64(m)
+}
+
+// Float64 returns the amount in points, inexact, for metrics only
+func (m Money) Float64() float64 {
+	return float64(m) / moneyScale
+}
+
+// String formats the amount as a decimal without trailing zeros: 500, 10.5, 729.98
+func (m Money) String() string {
+	sign := ""
+	v := uint64(m)
+	if m < 0 {
+		sign = "-"
+		v = uint64(-m)
+	}
+
+	units, cents := v/moneyScale, v%moneyScale
+	if cents == 0 {
+		return sign + strconv.FormatUint(units, 10)
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%02d", cents), "0")
+	return sign + strconv.FormatUint(units, 10) + "." + frac
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON parses a JSON number without going through float64,
+// digits below a kopeck are rounded half away from zero
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// ParseMoney parses a decimal number like "729.98" or "1e2" into Money
+func ParseMoney(s string) (Money, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || strings.ContainsAny(s, "/ ") {
+		return 0, fmt.Errorf("money: invalid amount %q", s)
+	}
+	r.Mul(r, big.NewRat(moneyScale, 1))
+
+	// round half away from zero: (2*num + sign*den) / (2*den) truncated
+	num := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	den := new(big.Int).Mul(r.Denom(), big.NewInt(2))
+	num.Add(num, new(big.Int).Mul(r.Denom(), big.NewInt(int64(r.Sign()))))
+	num.Quo(num, den)
+
+	if !num.IsInt64() {
+		return 0, fmt.Errorf("money: amount %q out of range", s)
+	}
+	return Money(num.Int64()), nil
+}
+
+// Value stores Money as bigint minor units
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
+
+// Scan reads Money from bigint minor units. Text is accepted for numeric
+// results like SUM(bigint), as long as it is a whole number of minor units.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case int64:
+		*m = Money(v)
+	case int32:
+		*m = Money(v)
+	case float64:
+		if math.Trunc(v) != v {
+			return fmt.Errorf("money: fractional minor units %v", v)
+		}
+		*m = Money(v)
+	case string:
+		return m.scanText(v)
+	case []byte:
+		return m.scanText(string(v))
+	default:
+		return fmt.Errorf("money: cannot scan %T", src)
+	}
+	return nil
+}
+
+func (m *Money) scanText(s string) error {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("money: minor units %q are not a bigint", s)
+	}
+	*m = Money(v)
+	return nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMoney(t *testing.T) {
+	tbl := []struct {
+		in   string
+		want Money
+	}{
+		{in: "0", want: 0},
+		{in: "500", want: 50000},
+		{in: "729.98", want: 72998},
+		{in: "10.5", want: 1050},
+		{in: "0.01", want: 1},
+		{in: "0.004", want: 0},
+		{in: "0.005", want: 1},   // half away from zero
+		{in: "0.015", want: 2},   // not banker's rounding
+		{in: "-0.005", want: -1}, // half away from zero on the negative side too
+		{in: "-12.344", want: -1234},
+		{in: "1e2", want: 10000},
+		{in: "1.5E1", want: 1500},
+		{in: "0.1", want: 10}, // no float64 on the way, 0.1 stays exact
+	}
+
+	for _, tt := range tbl {
+		got, err := ParseMoney(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+
+	for _, in := range []string{"", "abc", "1/3", "1 2", "1e30"} {
+		_, err := ParseMoney(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tbl := map[Money]string{
+		0:      "0",
+		50000:  "500",
+		1050:   "10.5",
+		72998:  "729.98",
+		1:      "0.01",
+		-72998: "-729.98",
+	}
+	for m, want := range tbl {
+		assert.Equal(t, want, m.String())
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var req struct {
+		Sum Money `json:"sum"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"sum": 751.1}`), &req))
+	assert.Equal(t, Money(75110), req.Sum)
+
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"sum": 751.1}`, string(data))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": "751"}`), &req))
+}
+
+func TestMoneyScan(t *testing.T) {
+	tbl := []struct {
+		name string
+		src  interface{}
+		want Money
+	}{
+		{name: "null", src: nil, want: 0},
+		{name: "bigint", src: int64(72998), want: 72998},
+		{name: "int", src: int32(-150), want: -150},
+		{name: "whole float", src: float64(1050), want: 1050},
+		{name: "numeric text", src: "72998", want: 72998},
+		{name: "negative numeric text", src: "-1050", want: -1050},
+		{name: "numeric bytes", src: []byte("500"), want: 500},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Money(42)
+			require.NoError(t, m.Scan(tt.src))
+			assert.Equal(t, tt.want, m)
+		})
+	}
+
+	bad := []struct {
+		name string
+		src  interface{}
+	}{
+		{name: "fractional float", src: 10.5},
+		{name: "fractional numeric", src: "729.98"},
+		{name: "not a number", src: "abc"},
+		{name: "empty", src: []byte{}},
+		{name: "bool", src: true},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Money
+			assert.Error(t, m.Scan(tt.src))
+		})
+	}
+}
+
+func TestMoneyValue(t *testing.T) {
+	v, err := Money(72998).Value()
+	require.NoError(t, err)
+	assert.Equal(t, int64(72998), v)
+}
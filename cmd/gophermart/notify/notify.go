@@ -0,0 +1,72 @@
+// Package notify delivers messages to users. The notifiers here are meant
+// for local use, a real deployment plugs in an email or messenger one.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// Log records notifications in the log for development. Reset tokens are
+// never written out, logs are shipped and kept where tokens must not be.
+type Log struct{}
+
+func (Log) PasswordReset(ctx context.Context, user models.User, _ string, expiresAt time.Time) error {
+	slog.WarnContext(ctx, "password reset requested, token not delivered",
+		"login", user.Login, "expires_at", expiresAt)
+	return nil
+}
+
+// File appends notifications to a file as JSON lines
+type File struct {
+	mu   sync.Mutex
+	path string
+}
+
+type fileMessage struct {
+	Kind      string    `json:"kind"`
+	Login     string    `json:"login"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) PasswordReset(ctx context.Context, user models.User, token string, expiresAt time.Time) error {
+	return f.write(fileMessage{
+		Kind:      "password_reset",
+		Login:     user.Login,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		SentAt:    time.Now(),
+	})
+}
+
+func (f *File) write(msg fileMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open notifications file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
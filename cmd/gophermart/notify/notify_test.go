@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/logging"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestLogPasswordReset(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := logging.Setup(&buf, logging.Config{Format: "json", Level: "info"})
+	require.NoError(t, err)
+	defer slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+
+	require.NoError(t, Log{}.PasswordReset(context.Background(), models.User{Login: "alice"}, "reset-token-1f3a", time.Now()))
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "alice", line["login"])
+	assert.NotContains(t, buf.String(), "reset-token-1f3a", "the token never reaches the log")
+}
+
+func TestFilePasswordReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+	f := NewFile(path)
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	require.NoError(t, f.PasswordReset(context.Background(), models.User{Login: "alice"}, "t1", expires))
+	require.NoError(t, f.PasswordReset(context.Background(), models.User{Login: "bob"}, "t2", expires))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var msg fileMessage
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &msg))
+	assert.Equal(t, "password_reset", msg.Kind)
+	assert.Equal(t, "bob", msg.Login)
+	assert.Equal(t, "t2", msg.Token)
+	assert.True(t, expires.Equal(msg.ExpiresAt))
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (s Server) adminSearchUsersCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminSearchUsersCtrl")
+
+	limit, offset, err := pagination(r)
+	if err != nil {
+		slog.WarnContext(ctx, "adminSearchUsersCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "invalid pagination"))
+		return
+	}
+
+	users, err := s.Service.SearchUsers(ctx, r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		slog.ErrorContext(ctx, "adminSearchUsersCtrl", "err", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errors.Wrap(err, "cannot search users"))
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, users)
+}
+
+func (s Server) adminUserOrdersCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminUserOrdersCtrl")
+
+	uid, ok := targetUID(w, r)
+	if !ok {
+		return
+	}
+
+	orders, err := s.Service.GetUserOrders(ctx, uid)
+	if renderAdminError(w, r, err) {
+		slog.ErrorContext(ctx, "adminUserOrdersCtrl", "err", err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, append([]models.OrderResponse{}, orders...))
+}
+
+func (s Server) adminUserWithdrawalsCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminUserWithdrawalsCtrl")
+
+	uid, ok := targetUID(w, r)
+	if !ok {
+		return
+	}
+
+	withdrawals, err := s.Service.GetUserWithdrawals(ctx, uid)
+	if renderAdminError(w, r, err) {
+		slog.ErrorContext(ctx, "adminUserWithdrawalsCtrl", "err", err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, append([]models.WithdrawalsResponse{}, withdrawals...))
+}
+
+func (s Server) adminUserBalanceCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminUserBalanceCtrl")
+
+	uid, ok := targetUID(w, r)
+	if !ok {
+		return
+	}
+
+	balance, err := s.Service.GetUserBalance(ctx, uid)
+	if renderAdminError(w, r, err) {
+		slog.ErrorContext(ctx, "adminUserBalanceCtrl", "err", err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, balance)
+}
+
+func (s Server) adminRepollOrderCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminRepollOrderCtrl")
+
+	actor := r.Context().Value(UserContextKey).(models.User)
+
+	err := s.Service.RequeueOrder(ctx, actor, chi.URLParam(r, "number"))
+	if renderAdminError(w, r, err) {
+		slog.ErrorContext(ctx, "adminRepollOrderCtrl", "err", err)
+		return
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, "order requeued")
+}
+
+func (s Server) adminAdjustBalanceCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.AdjustmentRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminAdjustBalanceCtrl")
+
+	actor := r.Context().Value(UserContextKey).(models.User)
+
+	uid, ok := targetUID(w, r)
+	if !ok {
+		return
+	}
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "adminAdjustBalanceCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	adj, err := s.Service.AdjustBalance(ctx, actor, uid, req.Amount, req.Reason)
+	if renderValidation(w, r, err) {
+		return
+	}
+	if errors.Is(err, models.ErrBalanceWrong) {
+		slog.ErrorContext(ctx, "adminAdjustBalanceCtrl", "err", err)
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, errors.Wrap(err, "adjustment makes the balance negative"))
+		return
+	}
+	if renderAdminError(w, r, err) {
+		slog.ErrorContext(ctx, "adminAdjustBalanceCtrl", "err", err)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, adj)
+}
+
+func (s Server) adminSetRoleCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.RoleRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminSetRoleCtrl")
+
+	actor := r.Context().Value(UserContextKey).(models.User)
+
+	uid, ok := targetUID(w, r)
+	if !ok {
+		return
+	}
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "adminSetRoleCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	err = s.Service.SetRole(ctx, actor, uid, req.Role)
+	if errors.Is(err, models.ErrRoleInvalid) {
+		slog.WarnContext(ctx, "adminSetRoleCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrapf(err, "unknown role %q", req.Role))
+		return
+	}
+	if renderAdminError(w, r, err) {
+		slog.ErrorContext(ctx, "adminSetRoleCtrl", "err", err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, "role set")
+}
+
+func (s Server) adminAuditCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "adminAuditCtrl")
+
+	query, err := auditQuery(r)
+	if err != nil {
+		slog.WarnContext(ctx, "adminAuditCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, err.Error())
+		return
+	}
+
+	entries, err := s.Service.GetAudit(ctx, query)
+	if err != nil {
+		slog.ErrorContext(ctx, "adminAuditCtrl", "err", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errors.Wrap(err, "cannot get audit log"))
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, entries)
+}
+
+// auditQuery parses the audit log filter: action, actor, target, order,
+// since and until (RFC 3339) and the usual pagination
+func auditQuery(r *http.Request) (query models.AuditQuery, err error) {
+	q := r.URL.Query()
+	query.Limit, query.Offset, err = pagination(r)
+	if err != nil {
+		return query, err
+	}
+	query.Action = q.Get("action")
+	query.OrderID = q.Get("order")
+	if v := q.Get("actor"); v != "" {
+		if query.ActorUID, err = uuid.Parse(v); err != nil {
+			return query, errors.Wrap(err, "invalid actor")
+		}
+	}
+	if v := q.Get("target"); v != "" {
+		if query.TargetUID, err = uuid.Parse(v); err != nil {
+			return query, errors.Wrap(err, "invalid target")
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if query.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return query, errors.Wrap(err, "invalid since")
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if query.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return query, errors.Wrap(err, "invalid until")
+		}
+	}
+	return query, nil
+}
+
+// targetUID parses the {uid} URL parameter, writes 400 if it is not a uuid
+func targetUID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	uid, err := uuid.Parse(chi.URLParam(r, "uid"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "invalid user id"))
+		return uuid.Nil, false
+	}
+	return uid, true
+}
+
+// renderAdminError writes the response for errors common to the admin endpoints,
+// true means the response is written
+func renderAdminError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, models.ErrUserNotFound):
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, errors.Wrap(err, "user not found"))
+	case errors.Is(err, models.ErrOrderNotFound):
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, errors.Wrap(err, "order not found"))
+	case errors.Is(err, models.ErrOrderStatusTransition):
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, errors.Wrap(err, "order is already final"))
+	default:
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errors.Wrap(err, "internal error"))
+	}
+	return true
+}
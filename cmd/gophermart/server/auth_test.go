@@ -0,0 +1,169 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/service"
+	"github.com/stsg/gophermart/cmd/gophermart/store/memory"
+)
+
+// testServer serves the routes over a fresh in-memory storage
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	keys := lib.NewKeySet()
+	require.NoError(t, keys.AddSecret("test", []byte(uuid.NewString())))
+	require.NoError(t, keys.SetSigningKey("test"))
+	srvc := service.New(memory.New(), &service.Config{
+		Keys:       keys,
+		AccessTTL:  time.Minute,
+		RefreshTTL: time.Hour,
+		Policy:     service.Policy{LoginMinLen: 3, LoginMaxLen: 64, PasswordMinLen: 8},
+		BcryptCost: bcrypt.MinCost,
+	})
+
+	ts := httptest.NewServer(Server{Service: srvc}.routes())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// register signs a user up and returns the cookies and the bare access token
+func register(t *testing.T, ts *httptest.Server, login string) (cookies map[string]*http.Cookie, access string) {
+	t.Helper()
+
+	resp, err := http.Post(ts.URL+"/api/user/register", "application/json",
+		strings.NewReader(`{"login":"`+login+`","password":"Secret123"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cookies = map[string]*http.Cookie{}
+	for _, c := range resp.Cookies() {
+		cookies[c.Name] = c
+	}
+	require.Contains(t, cookies, authCookie)
+	require.Contains(t, cookies, refreshCookie)
+	require.Contains(t, cookies, csrfCookie)
+	assert.True(t, cookies[authCookie].HttpOnly)
+	assert.True(t, cookies[refreshCookie].HttpOnly)
+	assert.False(t, cookies[csrfCookie].HttpOnly, "scripts read the CSRF token")
+	return cookies, resp.Header.Get("Authorization")
+}
+
+func TestAuthCookieCSRF(t *testing.T) {
+	ts := testServer(t)
+	cookies, access := register(t, ts, "alice")
+
+	do := func(method, path, body string, prepare func(r *http.Request)) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "text/plain")
+		prepare(req)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	withCookies := func(names ...string) func(r *http.Request) {
+		return func(r *http.Request) {
+			for _, name := range names {
+				r.AddCookie(cookies[name])
+			}
+		}
+	}
+	csrf := cookies[csrfCookie].Value
+
+	tbl := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		prepare func(r *http.Request)
+		want    int
+	}{
+		{name: "no credentials", method: http.MethodGet, path: "/api/user/balance", prepare: func(*http.Request) {}, want: http.StatusUnauthorized},
+		{name: "bearer", method: http.MethodGet, path: "/api/user/balance", want: http.StatusOK,
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+access) }},
+		{name: "bare token", method: http.MethodGet, path: "/api/user/balance", want: http.StatusOK,
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", access) }},
+		{name: "bad bearer", method: http.MethodGet, path: "/api/user/balance", want: http.StatusUnauthorized,
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+access+"x") }},
+		{name: "cookie read needs no CSRF", method: http.MethodGet, path: "/api/user/balance", want: http.StatusOK,
+			prepare: withCookies(authCookie)},
+		{name: "cookie write without CSRF header", method: http.MethodPost, path: "/api/user/orders", body: "12345678903",
+			want: http.StatusForbidden, prepare: withCookies(authCookie, csrfCookie)},
+		{name: "cookie write without CSRF cookie", method: http.MethodPost, path: "/api/user/orders", body: "12345678903",
+			want: http.StatusForbidden, prepare: func(r *http.Request) {
+				withCookies(authCookie)(r)
+				r.Header.Set(csrfHeader, csrf)
+			}},
+		{name: "cookie write with wrong CSRF header", method: http.MethodPost, path: "/api/user/orders", body: "12345678903",
+			want: http.StatusForbidden, prepare: func(r *http.Request) {
+				withCookies(authCookie, csrfCookie)(r)
+				r.Header.Set(csrfHeader, csrf+"x")
+			}},
+		{name: "cookie write with CSRF header", method: http.MethodPost, path: "/api/user/orders", body: "12345678903",
+			want: http.StatusAccepted, prepare: func(r *http.Request) {
+				withCookies(authCookie, csrfCookie)(r)
+				r.Header.Set(csrfHeader, csrf)
+			}},
+		{name: "bearer write needs no CSRF", method: http.MethodPost, path: "/api/user/orders", body: "79927398713",
+			want: http.StatusAccepted, prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+access)
+				withCookies(csrfCookie)(r)
+			}},
+		{name: "cookie refresh without CSRF header", method: http.MethodPost, path: "/api/user/token/refresh",
+			want: http.StatusForbidden, prepare: withCookies(refreshCookie, csrfCookie)},
+		{name: "cookie refresh with CSRF header", method: http.MethodPost, path: "/api/user/token/refresh",
+			want: http.StatusOK, prepare: func(r *http.Request) {
+				withCookies(refreshCookie, csrfCookie)(r)
+				r.Header.Set(csrfHeader, csrf)
+			}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, do(tt.method, tt.path, tt.body, tt.prepare))
+		})
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	tbl := []struct {
+		name       string
+		header     string
+		cookie     string
+		token      string
+		fromCookie bool
+	}{
+		{name: "bearer", header: "Bearer abc", token: "abc"},
+		{name: "bearer any case", header: "bearer  abc ", token: "abc"},
+		{name: "bare", header: "abc", token: "abc"},
+		{name: "header wins over cookie", header: "Bearer abc", cookie: "def", token: "abc"},
+		{name: "cookie", cookie: "def", token: "def", fromCookie: true},
+		{name: "none"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: authCookie, Value: tt.cookie})
+			}
+			token, fromCookie := accessToken(r)
+			assert.Equal(t, tt.token, token)
+			assert.Equal(t, tt.fromCookie, fromCookie)
+		})
+	}
+}
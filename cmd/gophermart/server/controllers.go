@@ -1,42 +1,55 @@
 package server
 
 import (
+	"archive/zip"
 	"context"
+	"encoding/json"
 	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
-	log "github.com/go-pkgz/lgr"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
 	"github.com/stsg/gophermart/cmd/gophermart/lib"
 	"github.com/stsg/gophermart/cmd/gophermart/models"
 )
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
 func (s Server) userRegisterCtrl(w http.ResponseWriter, r *http.Request) {
 	var req models.UserRegisterRequest
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userRegisterCtrl", reqID)
+	slog.InfoContext(ctx, "userRegisterCtrl")
 
 	err := render.DecodeJSON(r.Body, &req)
 	if err != nil {
-		log.Printf("[WARN] reqID %s userRegisterCtrl, %v", reqID, err)
+		slog.WarnContext(ctx, "userRegisterCtrl", "err", err)
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
 		return
 	}
 
-	log.Printf("[INFO] login %s userRegisterCtrl", req.Login)
+	slog.InfoContext(ctx, "userRegisterCtrl", "login", req.Login)
 
-	jwt, err := s.Service.Register(ctx, req.Login, req.Password)
+	tokens, err := s.Service.Register(ctx, req.Login, req.Password)
 	if err != nil {
+		if renderValidation(w, r, err) {
+			slog.WarnContext(ctx, "userRegisterCtrl", "err", err)
+			return
+		}
 		if errors.Is(err, models.ErrUserExists) {
 			w.WriteHeader(http.StatusConflict)
 			return
@@ -45,9 +58,8 @@ func (s Server) userRegisterCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[INFO] login %s registered userRegisterCtrl", req.Login)
-	w.Header().Set("Authorization", jwt)
-	render.Status(r, http.StatusOK)
+	slog.InfoContext(ctx, "userRegisterCtrl, registered", "login", req.Login)
+	renderTokens(w, r, tokens)
 }
 
 func (s Server) userLoginCtrl(w http.ResponseWriter, r *http.Request) {
@@ -56,24 +68,28 @@ func (s Server) userLoginCtrl(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userLoginCtrl", reqID)
+	slog.InfoContext(ctx, "userLoginCtrl")
 
 	err := render.DecodeJSON(r.Body, &req)
 	if err != nil {
-		log.Printf("[WARN] reqID %s userLoginCtrl, %v", reqID, err)
+		slog.WarnContext(ctx, "userLoginCtrl", "err", err)
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
 		return
 	}
 
-	// TODO: case insensitive login
-	// req.Login = strings.ToLower(req.Login)
-	log.Printf("[INFO] login %s userLoginCtrl", req.Login)
+	slog.InfoContext(ctx, "userLoginCtrl", "login", req.Login)
 
-	jwt, err := s.Service.Login(ctx, req.Login, req.Password)
+	tokens, mfa, err := s.Service.Login(ctx, req.Login, req.Password, clientIP(r))
 	if err != nil {
-		if errors.Is(err, models.ErrUserWrongPassword) {
+		if renderValidation(w, r, err) {
+			return
+		}
+		if renderLockout(w, err) {
+			slog.WarnContext(ctx, "userLoginCtrl, locked out", "login", req.Login)
+			return
+		}
+		if errors.Is(err, models.ErrUserWrongPassword) || errors.Is(err, models.ErrUserNotFound) {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -81,9 +97,354 @@ func (s Server) userLoginCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[INFO] login %s authenticated userLoginCtrl", req.Login)
-	w.Header().Set("Authorization", jwt)
+	if mfa != nil {
+		slog.InfoContext(ctx, "userLoginCtrl, second factor required", "login", req.Login)
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, mfa)
+		return
+	}
+
+	slog.InfoContext(ctx, "userLoginCtrl, authenticated", "login", req.Login)
+	renderTokens(w, r, tokens)
+}
+
+func (s Server) userRefreshCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userRefreshCtrl")
+
+	// browser clients send no body, the refresh token comes in its cookie then
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		slog.WarnContext(ctx, "userRefreshCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+	if req.RefreshToken == "" {
+		if cookie, cerr := r.Cookie(refreshCookie); cerr == nil {
+			if !checkCSRF(r) {
+				slog.WarnContext(ctx, "userRefreshCtrl, CSRF token mismatch")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			req.RefreshToken = cookie.Value
+		}
+	}
+
+	tokens, err := s.Service.Refresh(ctx, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) || errors.Is(err, models.ErrTokenRevoked) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	renderTokens(w, r, tokens)
+}
+
+func (s Server) userLogoutCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userLogoutCtrl")
+
+	user, _ := r.Context().Value(UserContextKey).(models.User)
+	sid, ok := r.Context().Value(SessionContextKey).(uuid.UUID)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	err := s.Service.Logout(ctx, user, sid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	clearAuthCookies(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s Server) userPasswordCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordChangeRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userPasswordCtrl")
+
+	user, ok := r.Context().Value(UserContextKey).(models.User)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "userPasswordCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	tokens, err := s.Service.ChangePassword(ctx, user, req.OldPassword, req.NewPassword)
+	if err != nil {
+		if renderValidation(w, r, err) {
+			return
+		}
+		if errors.Is(err, models.ErrUserWrongPassword) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	renderTokens(w, r, tokens)
+}
+
+func (s Server) userPasswordResetCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordResetRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userPasswordResetCtrl")
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "userPasswordResetCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	err = s.Service.RequestPasswordReset(ctx, req.Login, clientIP(r))
+	if err != nil {
+		if renderLockout(w, err) {
+			slog.WarnContext(ctx, "userPasswordResetCtrl, too many requests", "login", req.Login)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the same answer whether the login exists or not
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s Server) userPasswordResetConfirmCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordResetConfirmRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userPasswordResetConfirmCtrl")
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "userPasswordResetConfirmCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	err = s.Service.ConfirmPasswordReset(ctx, req.Token, req.NewPassword)
+	if err != nil {
+		if renderValidation(w, r, err) {
+			return
+		}
+		if errors.Is(err, models.ErrTokenInvalid) {
+			renderValidation(w, r, &models.ValidationError{Violations: []models.Violation{
+				{Field: "token", Rule: "invalid", Message: "reset token is invalid, used or expired"},
+			}})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s Server) userTOTPEnrollCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userTOTPEnrollCtrl")
+
+	user, ok := r.Context().Value(UserContextKey).(models.User)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	enrollment, err := s.Service.EnrollTOTP(ctx, user)
+	if err != nil {
+		if errors.Is(err, models.ErrTOTPEnabled) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, enrollment)
+}
+
+func (s Server) userTOTPVerifyCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.TOTPCodeRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userTOTPVerifyCtrl")
+
+	user, ok := r.Context().Value(UserContextKey).(models.User)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "userTOTPVerifyCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	codes, err := s.Service.VerifyTOTP(ctx, user, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTOTPEnabled), errors.Is(err, models.ErrTOTPNotEnrolled):
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, models.ErrTOTPCodeInvalid):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
 	render.Status(r, http.StatusOK)
+	render.JSON(w, r, codes)
+}
+
+func (s Server) userMFALoginCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.MFALoginRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userMFALoginCtrl")
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "userMFALoginCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	tokens, err := s.Service.CompleteMFALogin(ctx, req.MFAToken, req.Code, clientIP(r))
+	if err != nil {
+		if renderLockout(w, err) {
+			return
+		}
+		if errors.Is(err, models.ErrTokenInvalid) || errors.Is(err, models.ErrTOTPCodeInvalid) ||
+			errors.Is(err, models.ErrTOTPNotEnrolled) || errors.Is(err, models.ErrUserNotFound) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	renderTokens(w, r, tokens)
+}
+
+func (s Server) userDeleteCtrl(w http.ResponseWriter, r *http.Request) {
+	var req models.UserDeleteRequest
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userDeleteCtrl")
+
+	user, ok := r.Context().Value(UserContextKey).(models.User)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		slog.WarnContext(ctx, "userDeleteCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
+		return
+	}
+
+	err = s.Service.DeleteUser(ctx, user, req.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrUserWrongPassword) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	clearAuthCookies(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s Server) userExportCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userExportCtrl")
+
+	user, ok := r.Context().Value(UserContextKey).(models.User)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	export, err := s.Service.ExportUser(ctx, user)
+	if err != nil {
+		slog.ErrorContext(ctx, "userExportCtrl", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") != "zip" && !strings.Contains(r.Header.Get("Accept"), "application/zip") {
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="gophermart-export.zip"`)
+	w.WriteHeader(http.StatusOK)
+	err = writeExportZip(w, export)
+	if err != nil {
+		slog.ErrorContext(ctx, "userExportCtrl, cannot write zip", "err", err)
+	}
 }
 
 func (s Server) userPostOrdersCtrl(w http.ResponseWriter, r *http.Request) {
@@ -93,8 +454,7 @@ func (s Server) userPostOrdersCtrl(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userPostOrdersCtrl", reqID)
+	slog.InfoContext(ctx, "userPostOrdersCtrl")
 
 	user, ok := r.Context().Value(UserContextKey).(models.User)
 	if !ok {
@@ -105,7 +465,7 @@ func (s Server) userPostOrdersCtrl(w http.ResponseWriter, r *http.Request) {
 
 	req, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("[ERROR] reqID %s userPostOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userPostOrdersCtrl", "err", err)
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
 		return
@@ -114,14 +474,14 @@ func (s Server) userPostOrdersCtrl(w http.ResponseWriter, r *http.Request) {
 	orderString = string(req)
 	orderNumber, err = strconv.ParseInt(string(req), 10, 64)
 	if err != nil {
-		log.Printf("[ERROR] reqID %s userPostOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userPostOrdersCtrl", "err", err)
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, errors.Wrap(err, "cannot get order number"))
 		return
 	}
 
 	if !lib.LuhnValid(orderNumber) {
-		log.Printf("[ERROR] reqID %s userPostOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userPostOrdersCtrl", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
 		render.JSON(w, r, errors.Wrap(err, "invalid order number"))
 		return
@@ -130,36 +490,27 @@ func (s Server) userPostOrdersCtrl(w http.ResponseWriter, r *http.Request) {
 	order, err := s.Service.SaveOrder(ctx, user.Login, orderString)
 
 	if errors.Is(err, models.ErrOrderExists) {
-		log.Printf("[ERROR] reqID %s userPostOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userPostOrdersCtrl", "err", err)
 		render.Status(r, http.StatusOK)
 		render.JSON(w, r, errors.Wrap(err, "duplicate order number"))
 		return
 	}
 
 	if errors.Is(err, models.ErrOrderBelongsAnotherUser) {
-		log.Printf("[ERROR] reqID %s userPostOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userPostOrdersCtrl", "err", err)
 		render.Status(r, http.StatusConflict)
 		render.JSON(w, r, errors.Wrap(err, "order belongs another user"))
 		return
 	}
 
 	if err != nil {
-		log.Printf("[ERROR] reqID %s userPostOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userPostOrdersCtrl", "err", err)
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, errors.Wrap(err, "cannot save order"))
 		return
 	}
 
-	orderResponse := models.OrderResponse{
-		ID:         orderString,
-		Status:     string(order.AccrualStatus),
-		Amount:     lib.RoundFloat(float64(order.Amount)/100.00, 2),
-		UploadedAt: order.UploadedAt,
-	}
-
-	log.Printf("[INFO] trying to send order %s to Accrual service", orderString)
-	s.Service.ChanToAccurual <- orderResponse
-	log.Printf("[INFO] sent order %s to Accrual service", orderString)
+	slog.InfoContext(ctx, "order queued for Accrual service", "order", order.ID, "status", order.AccrualStatus)
 	render.Status(r, http.StatusAccepted)
 	render.JSON(w, r, "accepted")
 }
@@ -168,8 +519,7 @@ func (s Server) userGetOrdersCtrl(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userGetOrdersCtrl", reqID)
+	slog.InfoContext(ctx, "userGetOrdersCtrl")
 
 	user, ok := r.Context().Value(UserContextKey).(models.User)
 	if !ok {
@@ -180,14 +530,14 @@ func (s Server) userGetOrdersCtrl(w http.ResponseWriter, r *http.Request) {
 
 	orders, err := s.Service.GetOrders(ctx, user.Login)
 	if err != nil {
-		log.Printf("[ERROR] reqID %s userGetOrdersCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userGetOrdersCtrl", "err", err)
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, errors.Wrap(err, "cannot get orders"))
 		return
 	}
 
 	if len(orders) == 0 {
-		log.Printf("[INFO] reqID %s userGetOrdersCtrl, %v", reqID, err)
+		slog.InfoContext(ctx, "userGetOrdersCtrl", "err", err)
 		render.Status(r, http.StatusNoContent)
 		render.JSON(w, r, "no orders")
 		return
@@ -201,8 +551,7 @@ func (s Server) userBalanceCtrl(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userBalanceCtrl", reqID)
+	slog.InfoContext(ctx, "userBalanceCtrl")
 
 	user, ok := r.Context().Value(UserContextKey).(models.User)
 	if !ok {
@@ -213,7 +562,7 @@ func (s Server) userBalanceCtrl(w http.ResponseWriter, r *http.Request) {
 
 	balance, err := s.Service.GetBalance(ctx, user.Login)
 	if err != nil {
-		log.Printf("[ERROR] reqID %s userBalanceCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userBalanceCtrl", "err", err)
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, errors.Wrap(err, "cannot get balance"))
 		return
@@ -223,6 +572,45 @@ func (s Server) userBalanceCtrl(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, balance)
 }
 
+func (s Server) userBalanceHistoryCtrl(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	slog.InfoContext(ctx, "userBalanceHistoryCtrl")
+
+	user, ok := r.Context().Value(UserContextKey).(models.User)
+	if !ok {
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "unauthorized\n")
+		return
+	}
+
+	limit, offset, err := pagination(r)
+	if err != nil {
+		slog.WarnContext(ctx, "userBalanceHistoryCtrl", "err", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, errors.Wrap(err, "invalid pagination"))
+		return
+	}
+
+	entries, err := s.Service.GetBalanceHistory(ctx, user.Login, limit, offset)
+	if err != nil {
+		slog.ErrorContext(ctx, "userBalanceHistoryCtrl", "err", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errors.Wrap(err, "cannot get balance history"))
+		return
+	}
+
+	if len(entries) == 0 {
+		render.Status(r, http.StatusNoContent)
+		render.JSON(w, r, "no balance history")
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, entries)
+}
+
 func (s Server) userWithdrawCtrl(w http.ResponseWriter, r *http.Request) {
 	var req models.WithdrawRequest
 	// var res models.WithdrawResponse
@@ -230,8 +618,7 @@ func (s Server) userWithdrawCtrl(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userWithdrawCtrl", reqID)
+	slog.InfoContext(ctx, "userWithdrawCtrl")
 
 	user, ok := r.Context().Value(UserContextKey).(models.User)
 	if !ok {
@@ -242,7 +629,7 @@ func (s Server) userWithdrawCtrl(w http.ResponseWriter, r *http.Request) {
 
 	err := render.DecodeJSON(r.Body, &req)
 	if err != nil {
-		log.Printf("[WARN] reqID %s userWithdrawCtrl, %v", reqID, err)
+		slog.WarnContext(ctx, "userWithdrawCtrl", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
 		render.JSON(w, r, errors.Wrap(err, "failed to parse request body"))
 		return
@@ -250,35 +637,49 @@ func (s Server) userWithdrawCtrl(w http.ResponseWriter, r *http.Request) {
 
 	orderNumber, err := strconv.ParseInt(req.Number, 10, 64)
 	if err != nil {
-		log.Printf("[WARN] reqID %s userWithdrawCtrl, %v", reqID, err)
+		slog.WarnContext(ctx, "userWithdrawCtrl", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
 		render.JSON(w, r, errors.Wrap(err, "cannot get witdraw number"))
 		return
 	}
 
 	if !lib.LuhnValid(orderNumber) {
-		log.Printf("[ERROR] reqID %s userWithdrawCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userWithdrawCtrl", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
 		render.JSON(w, r, errors.Wrap(err, "invalid order number"))
 		return
 	}
 
-	err = s.Service.SaveWithdraw(ctx, user.Login, req.Number, int64(req.Accrual*100))
+	if req.Accrual <= 0 {
+		slog.WarnContext(ctx, "userWithdrawCtrl, wrong sum", "sum", req.Accrual)
+		render.Status(r, http.StatusUnprocessableEntity)
+		render.JSON(w, r, "sum must be positive")
+		return
+	}
+
+	err = s.Service.SaveWithdraw(ctx, user.Login, req.Number, req.Accrual)
 
 	if err == models.ErrOrderExists {
-		log.Printf("[ERROR] reqID %s userWithdrawCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userWithdrawCtrl", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
 		render.JSON(w, r, errors.Wrap(err, "duplicate order number"))
 		return
 	}
 
 	if err == models.ErrBalanceWrong {
-		log.Printf("[ERROR] reqID %s userWithdrawCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userWithdrawCtrl", "err", err)
 		render.Status(r, http.StatusPaymentRequired)
 		render.JSON(w, r, errors.Wrap(err, "not enough money in the account"))
 		return
 	}
 
+	if err != nil {
+		slog.ErrorContext(ctx, "userWithdrawCtrl", "err", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, errors.Wrap(err, "cannot save withdrawal"))
+		return
+	}
+
 	res := models.WithdrawResponse{
 		Number:      req.Number,
 		Accrual:     req.Accrual,
@@ -290,11 +691,10 @@ func (s Server) userWithdrawCtrl(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s Server) userGetWithdrawalsCtrl(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 50*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
 
-	reqID := middleware.GetReqID(ctx)
-	log.Printf("[INFO] reqID %s userWithdrawalsCtrl", reqID)
+	slog.InfoContext(ctx, "userWithdrawalsCtrl")
 
 	user, ok := r.Context().Value(UserContextKey).(models.User)
 	if !ok {
@@ -305,19 +705,108 @@ func (s Server) userGetWithdrawalsCtrl(w http.ResponseWriter, r *http.Request) {
 
 	withdrawals, err := s.Service.GetWithdrawals(ctx, user.Login)
 	if err != nil {
-		log.Printf("[ERROR] reqID %s userWithdrawalsCtrl, %v", reqID, err)
+		slog.ErrorContext(ctx, "userWithdrawalsCtrl", "err", err)
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, errors.Wrap(err, "cannot get withdrawals"))
 		return
 	}
 
 	if len(withdrawals) == 0 {
-		log.Printf("[ERROR] reqID %s userWithdrawalsCtrl, no withdrawals", reqID)
+		slog.InfoContext(ctx, "userWithdrawalsCtrl, no withdrawals")
 		render.Status(r, http.StatusNoContent)
-		render.JSON(w, r, "cannot get withdrawals")
+		render.JSON(w, r, "no withdrawals")
 		return
 	}
 
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, withdrawals)
 }
+
+// writeExportZip puts every part of the export into its own JSON file
+func writeExportZip(w io.Writer, export models.UserExport) error {
+	zw := zip.NewWriter(w)
+	for _, file := range []struct {
+		name string
+		part interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"balance.json", export.Balance},
+		{"orders.json", export.Orders},
+		{"withdrawals.json", export.Withdrawals},
+		{"balance_history.json", export.BalanceHistory},
+	} {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.part); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// renderTokens hands the token pair out in the body, the Authorization header and cookies
+func renderTokens(w http.ResponseWriter, r *http.Request, tokens models.TokenResponse) {
+	err := setAuthCookies(w, r, tokens)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "cannot set auth cookies", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Authorization", tokens.AccessToken)
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, tokens)
+}
+
+// renderLockout answers 429 with Retry-After if err is a LockoutError
+func renderLockout(w http.ResponseWriter, err error) bool {
+	var lockErr *models.LockoutError
+	if !errors.As(err, &lockErr) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockErr.RetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	return true
+}
+
+// renderValidation answers 400 with the broken rules if err is a ValidationError
+func renderValidation(w http.ResponseWriter, r *http.Request, err error) bool {
+	var verr *models.ValidationError
+	if !errors.As(err, &verr) {
+		return false
+	}
+	render.Status(r, http.StatusBadRequest)
+	render.JSON(w, r, JSON{"error": models.ErrValidation.Error(), "violations": verr.Violations})
+	return true
+}
+
+// clientIP returns the client address without port, RealIP has already
+// put the one from X-Forwarded-For or X-Real-IP into RemoteAddr
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pagination reads limit and offset query params, limit defaults to defaultPageSize
+func pagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, errors.Errorf("limit must be from 1 to %d", maxPageSize)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative number")
+		}
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+const (
+	authCookie    = "gophermart_token"
+	refreshCookie = "gophermart_refresh"
+	csrfCookie    = "gophermart_csrf"
+	csrfHeader    = "X-CSRF-Token"
+
+	refreshCookiePath = "/api/user/token"
+)
+
+// accessToken takes the token from "Authorization: Bearer <token>", a bare
+// token in the header for older clients, or the auth cookie
+func accessToken(r *http.Request) (token string, fromCookie bool) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token), false
+		}
+		return header, false
+	}
+
+	if cookie, err := r.Cookie(authCookie); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// checkCSRF guards cookie authenticated requests with the double submit cookie:
+// state-changing ones must echo the CSRF cookie in the X-CSRF-Token header
+func checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(csrfHeader)
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
+
+// setAuthCookies hands the tokens to browser clients. Tokens are HttpOnly,
+// the CSRF token is left readable for scripts to send it back in the header
+func setAuthCookies(w http.ResponseWriter, r *http.Request, tokens models.TokenResponse) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	secure := isSecure(r)
+	refreshAge := int(tokens.RefreshExpiresIn)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookie,
+		Value:    tokens.AccessToken,
+		Path:     "/",
+		MaxAge:   int(tokens.ExpiresIn),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    tokens.RefreshToken,
+		Path:     refreshCookiePath,
+		MaxAge:   refreshAge,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(buf),
+		Path:     "/",
+		MaxAge:   refreshAge,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func clearAuthCookies(w http.ResponseWriter, r *http.Request) {
+	for name, path := range map[string]string{authCookie: "/", refreshCookie: refreshCookiePath, csrfCookie: "/"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     path,
+			MaxAge:   -1,
+			Expires:  time.Unix(0, 0),
+			Secure:   isSecure(r),
+			HttpOnly: name != csrfCookie,
+		})
+	}
+}
+
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -5,16 +5,26 @@ import (
 	"compress/gzip"
 	"context"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	log "github.com/go-pkgz/lgr"
-
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/stsg/gophermart/cmd/gophermart/logging"
+	"github.com/stsg/gophermart/cmd/gophermart/metrics"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
 	"github.com/stsg/gophermart/cmd/gophermart/service"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
 )
 
 // JSON is a map alias, just for convenience
@@ -33,12 +43,16 @@ const maxBody = 1024
 
 type ContextKey string
 
-const UserContextKey ContextKey = "user"
+const (
+	UserContextKey    ContextKey = "user"
+	SessionContextKey ContextKey = "session"
+)
 
 var reMultWhtsp = regexp.MustCompile(`[\s\p{Zs}]{2,}`)
 
-// Logger middleware prints http log. Customized by set of LoggerFlag
-func Logger(l log.L, flags ...LoggerFlag) func(http.Handler) http.Handler {
+// Logger middleware prints http log. Customized by set of LoggerFlag,
+// sensitive fields of the body and the query are masked
+func Logger(l *slog.Logger, flags ...LoggerFlag) func(http.Handler) http.Handler {
 
 	inFlags := func(f LoggerFlag) bool {
 		for _, flg := range flags {
@@ -57,7 +71,7 @@ func Logger(l log.L, flags ...LoggerFlag) func(http.Handler) http.Handler {
 			body := func() (result string) {
 				if inFlags(LogBody) {
 					if content, err := io.ReadAll(r.Body); err == nil {
-						result = string(content)
+						result = logging.RedactBody(content)
 						r.Body = io.NopCloser(bytes.NewReader(content))
 
 						if len(result) > 0 {
@@ -77,13 +91,22 @@ func Logger(l log.L, flags ...LoggerFlag) func(http.Handler) http.Handler {
 			defer func() {
 				t2 := time.Now()
 
-				q := r.URL.String()
+				q := logging.RedactURL(r.URL)
 				if qun, err := url.QueryUnescape(q); err == nil {
 					q = qun
 				}
-				l.Logf("[INFO] REST %s - %s - %s - %d (%d) - %v %s",
-					r.Method, q, strings.Split(r.RemoteAddr, ":")[0],
-					ww.Status(), ww.BytesWritten(), t2.Sub(t1), body)
+				attrs := []slog.Attr{
+					slog.String("method", r.Method),
+					slog.String("url", q),
+					slog.String("ip", strings.Split(r.RemoteAddr, ":")[0]),
+					slog.Int("status", ww.Status()),
+					slog.Int("bytes", ww.BytesWritten()),
+					slog.Duration("duration", t2.Sub(t1)),
+				}
+				if body != "" {
+					attrs = append(attrs, slog.String("body", body))
+				}
+				l.LogAttrs(r.Context(), slog.LevelInfo, "REST", attrs...)
 			}()
 
 			h.ServeHTTP(ww, r)
@@ -96,7 +119,7 @@ func Logger(l log.L, flags ...LoggerFlag) func(http.Handler) http.Handler {
 
 func Authorize(s *service.Service) func(http.Handler) http.Handler {
 
-	log.Print("Authorize middleware enabled")
+	slog.Debug("Authorize middleware enabled")
 
 	f := func(h http.Handler) http.Handler {
 
@@ -105,21 +128,152 @@ func Authorize(s *service.Service) func(http.Handler) http.Handler {
 			ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 			defer cancel()
 
-			reqID := middleware.GetReqID(ctx)
-
-			jwtString := r.Header.Get("Authorization")
+			jwtString, fromCookie := accessToken(r)
 			if jwtString == "" {
-				log.Printf("[WARN] Authorization header is not set in req %s", reqID)
+				slog.WarnContext(ctx, "neither Authorization header nor auth cookie is set")
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
+			if fromCookie && !checkCSRF(r) {
+				slog.WarnContext(ctx, "CSRF token mismatch")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 
-			user, err := s.GetUserByToken(ctx, jwtString)
+			user, sid, err := s.GetUserByToken(ctx, jwtString)
 			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), UserContextKey, user)))
+			logging.Add(ctx, slog.String("uid", user.UID.String()))
+			rctx := context.WithValue(r.Context(), UserContextKey, user)
+			rctx = context.WithValue(rctx, SessionContextKey, sid)
+			h.ServeHTTP(w, r.WithContext(rctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+
+	return f
+}
+
+// Metrics counts requests and their latency per chi route pattern
+func Metrics() func(http.Handler) http.Handler {
+
+	f := func(h http.Handler) http.Handler {
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			start := time.Now()
+			h.ServeHTTP(ww, r)
+
+			var route string
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			metrics.ObserveHTTP(r.Method, route, status, time.Since(start))
+		}
+		return http.HandlerFunc(fn)
+	}
+
+	return f
+}
+
+// Tracing starts the server span of the request, continuing the trace of the
+// caller if it sent a traceparent. The span is named after the chi route pattern.
+func Tracing() func(http.Handler) http.Handler {
+
+	f := func(h http.Handler) http.Handler {
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracing.Start(ctx, r.Method+" "+r.URL.Path,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.method", r.Method),
+					attribute.String("http.target", r.URL.Path),
+					attribute.String("http.request_id", middleware.GetReqID(ctx)),
+				),
+			)
+			defer span.End()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			h.ServeHTTP(ww, r.WithContext(ctx))
+
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+				span.SetAttributes(attribute.String("http.route", rctx.RoutePattern()))
+			}
+			span.SetAttributes(attribute.Int("http.status_code", ww.Status()))
+			if ww.Status() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(ww.Status()))
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+
+	return f
+}
+
+// AuditMeta puts the client address and the request id into the context for audit entries,
+// must go after RequestID and RealIP
+func AuditMeta() func(http.Handler) http.Handler {
+
+	f := func(h http.Handler) http.Handler {
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := models.WithAuditMeta(r.Context(), models.AuditMeta{
+				IP:        clientIP(r),
+				RequestID: middleware.GetReqID(r.Context()),
+			})
+			h.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+
+	return f
+}
+
+// LogScope gives the request a logging scope with its request ID, handlers
+// add to it what they learn, the user for one
+func LogScope() func(http.Handler) http.Handler {
+
+	f := func(h http.Handler) http.Handler {
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := logging.WithScope(r.Context())
+			logging.Add(ctx, slog.String("request_id", middleware.GetReqID(ctx)))
+			h.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+
+	return f
+}
+
+// RequireRole lets through only users with one of the roles, must go after Authorize
+func RequireRole(roles ...models.Role) func(http.Handler) http.Handler {
+
+	f := func(h http.Handler) http.Handler {
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(UserContextKey).(models.User)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if user.Role == role {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			slog.WarnContext(r.Context(), "role denied",
+				"login", user.Login, "role", user.Role, "method", r.Method, "path", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
 		}
 		return http.HandlerFunc(fn)
 	}
@@ -136,7 +290,7 @@ func Authorize(s *service.Service) func(http.Handler) http.Handler {
 
 func Decompress() func(http.Handler) http.Handler {
 
-	log.Print("Decompress middleware enabled")
+	slog.Debug("Decompress middleware enabled")
 
 	f := func(h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
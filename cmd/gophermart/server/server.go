@@ -2,27 +2,45 @@ package server
 
 import (
 	"context"
+	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
-	log "github.com/go-pkgz/lgr"
 	"github.com/go-pkgz/rest"
 	"github.com/pkg/errors"
 
+	"github.com/stsg/gophermart/cmd/gophermart/logging"
+	"github.com/stsg/gophermart/cmd/gophermart/metrics"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
 	"github.com/stsg/gophermart/cmd/gophermart/service"
 )
 
 type Server struct {
-	RunAddr string
-	AccAddr string
-	Service *service.Service
+	RunAddr      string
+	AccAddr      string
+	Service      *service.Service
+	DrainTimeout time.Duration // how long in-flight requests may finish after ctx is done
+	DrainDelay   time.Duration // how long readiness fails before the listener closes
 }
 
+// Run listens on RunAddr and serves until ctx is done, see Serve
 func (s Server) Run(ctx context.Context) error {
-	log.Printf("[INFO] activate server")
+	ln, err := net.Listen("tcp", s.RunAddr)
+	if err != nil {
+		return errors.Wrap(err, "server failed")
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves on ln until ctx is done. On shutdown readiness fails at once,
+// the listener closes after DrainDelay and Serve returns when in-flight
+// requests have finished or DrainTimeout passed.
+func (s Server) Serve(ctx context.Context, ln net.Listener) error {
+	slog.Info("activate server", "address", ln.Addr().String())
 
 	httpServer := &http.Server{
 		Addr:              s.RunAddr,
@@ -32,45 +50,90 @@ func (s Server) Run(ctx context.Context) error {
 		IdleTimeout:       30 * time.Second,
 	}
 
+	drained := make(chan struct{})
 	go func() {
+		defer close(drained)
 		<-ctx.Done()
-		if httpServer != nil {
+		// let load balancers see the failing readiness before new connections are refused
+		s.Service.Drain()
+		if s.DrainDelay > 0 {
+			slog.Info("not ready, draining http server after delay", "delay", s.DrainDelay)
+			time.Sleep(s.DrainDelay)
+		}
+		slog.Info("draining http server", "timeout", s.DrainTimeout)
+
+		drainCtx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(drainCtx); err != nil {
+			slog.Warn("http server not drained", "err", err)
 			if clsErr := httpServer.Close(); clsErr != nil {
-				log.Printf("[ERROR] failed to close http server, %v", clsErr)
+				slog.Error("failed to close http server", "err", clsErr)
 			}
 		}
 	}()
 
-	err := httpServer.ListenAndServe()
-	log.Printf("[WARN] server terminated, %s", err)
-
+	err := httpServer.Serve(ln)
 	if !errors.Is(err, http.ErrServerClosed) {
 		return errors.Wrap(err, "server failed")
 	}
+
+	// Serve returns as soon as Shutdown starts, in-flight requests are still running
+	<-drained
+	slog.Info("server terminated")
 	return nil
 }
 
 func (s Server) routes() chi.Router {
 	router := chi.NewRouter()
 
-	router.Use(middleware.RequestID, middleware.RealIP, rest.Recoverer(log.Default()))
+	router.Use(middleware.RequestID, middleware.RealIP, LogScope(), AuditMeta(), Metrics(), Tracing(),
+		rest.Recoverer(logging.Printf{Logger: slog.Default(), Level: slog.LevelError}))
 	router.Use(middleware.Throttle(1000), middleware.Timeout(60*time.Second))
 	router.Use(middleware.Compress(5, "application/json", "text/html"))
 	router.Use(Decompress())
 
 	router.Get("/ping", s.getPing)
+	router.Get("/health/live", s.getLive)
+	router.Get("/health/ready", s.getReady)
+	router.Handle("/metrics", metrics.Handler())
+	router.Get("/.well-known/jwks.json", s.getJWKS)
 	router.Route("/api", func(r chi.Router) {
-		r.Use(Logger(log.Default()))
+		r.Use(Logger(slog.Default()))
 		r.Post("/user/register", s.userRegisterCtrl)
 		r.Post("/user/login", s.userLoginCtrl)
+		r.Post("/user/token/refresh", s.userRefreshCtrl)
+		r.Post("/user/2fa/login", s.userMFALoginCtrl)
+		r.Post("/user/password/reset", s.userPasswordResetCtrl)
+		r.Post("/user/password/reset/confirm", s.userPasswordResetConfirmCtrl)
 		r.Group(func(r chi.Router) {
 			r.Use(Authorize(s.Service))
+			r.Post("/user/logout", s.userLogoutCtrl)
+			r.Post("/user/password", s.userPasswordCtrl)
+			r.Post("/user/2fa/enroll", s.userTOTPEnrollCtrl)
+			r.Post("/user/2fa/verify", s.userTOTPVerifyCtrl)
+			r.Delete("/user", s.userDeleteCtrl)
+			r.Get("/user/export", s.userExportCtrl)
 			r.Post("/user/orders", s.userPostOrdersCtrl)
 			r.Get("/user/orders", s.userGetOrdersCtrl)
 			r.Get("/user/balance", s.userBalanceCtrl)
+			r.Get("/user/balance/history", s.userBalanceHistoryCtrl)
 			r.Post("/user/balance/withdraw", s.userWithdrawCtrl)
 			r.Get("/user/withdrawals", s.userGetWithdrawalsCtrl)
 		})
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(Authorize(s.Service), RequireRole(models.RoleSupport, models.RoleAdmin))
+			r.Get("/users", s.adminSearchUsersCtrl)
+			r.Get("/users/{uid}/orders", s.adminUserOrdersCtrl)
+			r.Get("/users/{uid}/withdrawals", s.adminUserWithdrawalsCtrl)
+			r.Get("/users/{uid}/balance", s.adminUserBalanceCtrl)
+			r.Post("/orders/{number}/repoll", s.adminRepollOrderCtrl)
+			r.Group(func(r chi.Router) {
+				r.Use(RequireRole(models.RoleAdmin))
+				r.Post("/users/{uid}/adjustments", s.adminAdjustBalanceCtrl)
+				r.Put("/users/{uid}/role", s.adminSetRoleCtrl)
+				r.Get("/audit", s.adminAuditCtrl)
+			})
+		})
 	})
 
 	return router
@@ -80,3 +143,29 @@ func (s Server) getPing(w http.ResponseWriter, r *http.Request) {
 	render.Status(r, http.StatusOK)
 	render.PlainText(w, r, "pong\n")
 }
+
+// getLive answers as long as the process serves http
+func (s Server) getLive(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, models.HealthResponse{Status: models.HealthOK})
+}
+
+// getReady reports whether gophermart can take traffic, 503 if any component fails
+func (s Server) getReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	health := s.Service.Ready(ctx)
+	if health.Status != models.HealthOK {
+		slog.WarnContext(ctx, "not ready", "components", health.Components)
+		render.Status(r, http.StatusServiceUnavailable)
+	} else {
+		render.Status(r, http.StatusOK)
+	}
+	render.JSON(w, r, health)
+}
+
+func (s Server) getJWKS(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, s.Service.JWKS())
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+// SearchUsers finds users by a login substring or the exact uid. Deleted
+// users are listed with their deleted flag so support can tell a deleted
+// account from an unknown one, but the views below do not open them: a
+// deleted account is out of reach for support as it is for its owner, only
+// the anonymizer touches it during the retention period.
+func (s *Service) SearchUsers(ctx context.Context, query string, limit, offset int) ([]models.UserSummary, error) {
+	return s.storage.SearchUsers(ctx, strings.TrimSpace(query), limit, offset)
+}
+
+// GetUserOrders returns the orders of any user, for support staff,
+// deleted users are not found
+func (s *Service) GetUserOrders(ctx context.Context, uid uuid.UUID) ([]models.OrderResponse, error) {
+	user, err := s.storage.GetUserByUUID(ctx, uid)
+	if err != nil {
+		return nil, models.ErrUserNotFound
+	}
+	return s.storage.GetOrders(ctx, user.UID)
+}
+
+// GetUserWithdrawals returns the withdrawals of any user, for support staff,
+// deleted users are not found
+func (s *Service) GetUserWithdrawals(ctx context.Context, uid uuid.UUID) ([]models.WithdrawalsResponse, error) {
+	user, err := s.storage.GetUserByUUID(ctx, uid)
+	if err != nil {
+		return nil, models.ErrUserNotFound
+	}
+	return s.storage.GetWithdrawals(ctx, user.UID)
+}
+
+// GetUserBalance returns the balance of any user, for support staff,
+// deleted users are not found
+func (s *Service) GetUserBalance(ctx context.Context, uid uuid.UUID) (models.BalanceResponse, error) {
+	user, err := s.storage.GetUserByUUID(ctx, uid)
+	if err != nil {
+		return models.BalanceResponse{}, models.ErrUserNotFound
+	}
+	return s.storage.GetBalance(ctx, user.UID)
+}
+
+// RequeueOrder makes the accrual workers pick the order up at once,
+// for orders stuck after the accrual system lost or rejected them
+func (s *Service) RequeueOrder(ctx context.Context, actor models.User, orderNum string) error {
+	ctx, span := tracing.Start(ctx, "Service.RequeueOrder")
+	defer span.End()
+
+	err := s.storage.RequeueAccrualJob(ctx, orderNum, models.AuditEntry{
+		Action:   models.AuditOrderRepoll,
+		ActorUID: actor.UID,
+		OrderID:  orderNum,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot requeue order", "order", orderNum, "err", err)
+		return err
+	}
+	slog.InfoContext(ctx, "requeued order", "actor_role", actor.Role, "actor", actor.Login, "order", orderNum)
+	return nil
+}
+
+// AdjustBalance credits or debits the user's balance by hand, the reason
+// is mandatory and goes to the audit log along with the admin, deleted
+// users are not found
+func (s *Service) AdjustBalance(ctx context.Context, actor models.User, uid uuid.UUID, amount models.Money, reason string) (models.Adjustment, error) {
+	ctx, span := tracing.Start(ctx, "Service.AdjustBalance")
+	defer span.End()
+
+	var violations []models.Violation
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		violations = append(violations, violation("reason", "required", "reason is required"))
+	}
+	if amount == 0 {
+		violations = append(violations, violation("amount", "required", "amount must not be zero"))
+	}
+	if len(violations) > 0 {
+		return models.Adjustment{}, &models.ValidationError{Violations: violations}
+	}
+
+	user, err := s.storage.GetUserByUUID(ctx, uid)
+	if err != nil {
+		return models.Adjustment{}, models.ErrUserNotFound
+	}
+
+	adj := models.Adjustment{
+		ID:        "adj-" + uuid.New().String(),
+		UID:       user.UID,
+		ActorUID:  actor.UID,
+		Amount:    amount,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	details, err := json.Marshal(map[string]interface{}{"amount": amount, "reason": reason})
+	if err != nil {
+		return models.Adjustment{}, err
+	}
+
+	err = s.storage.AdjustBalance(ctx, adj, models.AuditEntry{
+		Action:    models.AuditBalanceAdjust,
+		ActorUID:  actor.UID,
+		TargetUID: user.UID,
+		OrderID:   adj.ID,
+		Details:   details,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot adjust balance", "login", user.Login, "err", err)
+		return models.Adjustment{}, err
+	}
+	slog.InfoContext(ctx, "admin adjusted balance", "actor", actor.Login, "login", user.Login, "amount", amount, "reason", reason)
+	return adj, nil
+}
+
+// SetRole changes the role of the user
+func (s *Service) SetRole(ctx context.Context, actor models.User, uid uuid.UUID, role models.Role) error {
+	ctx, span := tracing.Start(ctx, "Service.SetRole")
+	defer span.End()
+
+	if !role.Valid() {
+		return models.ErrRoleInvalid
+	}
+
+	details, err := json.Marshal(map[string]interface{}{"role": role})
+	if err != nil {
+		return err
+	}
+	err = s.storage.SetUserRole(ctx, uid, role, models.AuditEntry{
+		Action:    models.AuditUserRole,
+		ActorUID:  actor.UID,
+		TargetUID: uid,
+		Details:   details,
+	})
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "admin set user role", "actor", actor.Login, "uid", uid, "role", role)
+	return nil
+}
+
+// BootstrapAdmins grants the admin role to the given logins while there is no
+// admin at all, so the very first admin does not need SQL. Only registered
+// accounts are promoted, and never one whose role was changed before: a role
+// decided through the admin API is not undone on restart.
+func (s *Service) BootstrapAdmins(ctx context.Context, logins []string) error {
+	if len(logins) == 0 {
+		return nil
+	}
+	admins, err := s.storage.CountUsersByRole(ctx, models.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if admins > 0 {
+		slog.InfoContext(ctx, "admins exist, admin logins are ignored", "admins", admins)
+		return nil
+	}
+
+	for _, login := range logins {
+		user, err := s.findUser(ctx, login)
+		if err != nil {
+			slog.WarnContext(ctx, "admin login is not registered, not promoted", "login", login)
+			continue
+		}
+		changes, err := s.storage.GetAudit(ctx, models.AuditQuery{Action: models.AuditUserRole, TargetUID: user.UID, Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			slog.WarnContext(ctx, "admin login had its role changed before, not promoted", "login", login)
+			continue
+		}
+
+		err = s.storage.SetUserRole(ctx, user.UID, models.RoleAdmin, models.AuditEntry{
+			Action:    models.AuditUserRole,
+			ActorUID:  models.SystemActor,
+			TargetUID: user.UID,
+			Details:   models.AuditValues(map[string]interface{}{"role": models.RoleAdmin, "reason": "admin login bootstrap"}),
+		})
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "admin role granted to admin login", "login", user.Login)
+	}
+	return nil
+}
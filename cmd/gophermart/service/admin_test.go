@@ -0,0 +1,86 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/store/memory"
+)
+
+func TestAdminDeletedUser(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			ctx := testContext(t)
+
+			user := testUser(t, storage)
+			testCredit(t, storage, user, 10000)
+			admin := testUser(t, storage)
+
+			_, err := srvc.GetUserBalance(ctx, user.UID)
+			require.NoError(t, err)
+
+			_, err = storage.DeleteUser(ctx, user.UID)
+			require.NoError(t, err)
+
+			// search still lists the account, flagged deleted
+			found, err := srvc.SearchUsers(ctx, user.UID.String(), 10, 0)
+			require.NoError(t, err)
+			require.Len(t, found, 1)
+			assert.True(t, found[0].Deleted)
+
+			// but support cannot open it
+			_, err = srvc.GetUserBalance(ctx, user.UID)
+			assert.ErrorIs(t, err, models.ErrUserNotFound)
+			_, err = srvc.GetUserOrders(ctx, user.UID)
+			assert.ErrorIs(t, err, models.ErrUserNotFound)
+			_, err = srvc.GetUserWithdrawals(ctx, user.UID)
+			assert.ErrorIs(t, err, models.ErrUserNotFound)
+			_, err = srvc.AdjustBalance(ctx, admin, user.UID, 100, "goodwill")
+			assert.ErrorIs(t, err, models.ErrUserNotFound)
+		})
+	}
+}
+
+func TestBootstrapAdmins(t *testing.T) {
+	// the bootstrap depends on whether any admin exists, so every storage starts empty
+	storage := memory.New()
+	srvc := testService(t, storage)
+	ctx := testContext(t)
+
+	// listing a login grants nothing on registration, it could be anyone's
+	_, err := srvc.Register(ctx, "boss", "Secret123")
+	require.NoError(t, err)
+	boss, err := storage.GetUserByLogin(ctx, "boss")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, boss.Role)
+
+	require.NoError(t, srvc.BootstrapAdmins(ctx, []string{"nobody", " BOSS "}))
+	boss, err = storage.GetUserByLogin(ctx, "boss")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, boss.Role)
+
+	entries, err := srvc.GetAudit(ctx, models.AuditQuery{Action: models.AuditUserRole, TargetUID: boss.UID, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, models.SystemActor, entries[0].ActorUID)
+	assert.JSONEq(t, `{"role":"admin"}`, string(entries[0].After))
+
+	// with an admin around a restart changes nothing
+	_, err = srvc.Register(ctx, "deputy", "Secret123")
+	require.NoError(t, err)
+	require.NoError(t, srvc.BootstrapAdmins(ctx, []string{"boss", "deputy"}))
+	deputy, err := storage.GetUserByLogin(ctx, "deputy")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, deputy.Role)
+
+	// a demotion through the admin API survives restarts, even with no admin left
+	require.NoError(t, srvc.SetRole(ctx, boss, boss.UID, models.RoleSupport))
+	require.NoError(t, srvc.BootstrapAdmins(ctx, []string{"boss"}))
+	boss, err = storage.GetUserByLogin(ctx, "boss")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleSupport, boss.Role)
+}
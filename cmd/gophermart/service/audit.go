@@ -0,0 +1,32 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// audit records an event done outside of storage transactions. A failure
+// does not fail the action, the entry goes to the log instead.
+func (s *Service) audit(ctx context.Context, entry models.AuditEntry) {
+	err := s.storage.AppendAudit(ctx, entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "audit entry lost", "action", entry.Action, "actor", entry.ActorUID,
+			"target", entry.TargetUID, "details", string(entry.Details), "err", err)
+	}
+}
+
+// loginHash identifies a login in the audit log without storing it. The audit
+// log is append-only, so a login written there would outlive the anonymization
+// of a deleted account; entries name users by uid and failed attempts on
+// logins that do not exist by this hash.
+func (s *Service) loginHash(login string) string {
+	return lib.KeyedHash(s.auditKey, NormalizeLogin(login))
+}
+
+// GetAudit returns the audit entries matching the query, newest first
+func (s *Service) GetAudit(ctx context.Context, query models.AuditQuery) ([]models.AuditEntry, error) {
+	return s.storage.GetAudit(ctx, query)
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// TestAuditNoLogins checks that no login reaches the append-only audit log,
+// where the anonymizer could not erase it
+func TestAuditNoLogins(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			srvc.loginLimits = LoginLimits{MaxFailures: 1, Window: time.Minute, Lockout: time.Minute, MaxLockout: time.Minute}
+			ctx := testContext(t)
+
+			known := "audit-" + strings.ToLower(testOrderNumber())
+			unknown := "nobody-" + strings.ToLower(testOrderNumber())
+
+			_, err := srvc.Register(ctx, known, "Secret123")
+			require.NoError(t, err)
+			user, err := storage.GetUserByLogin(ctx, known)
+			require.NoError(t, err)
+
+			// a single failure locks out, so both attempts end in LockoutError
+			var lockoutErr *models.LockoutError
+			_, _, err = srvc.Login(ctx, known, "Wrong1234", "")
+			assert.ErrorAs(t, err, &lockoutErr)
+			_, _, err = srvc.Login(ctx, unknown, "Secret123", "")
+			assert.ErrorAs(t, err, &lockoutErr)
+
+			entries, err := srvc.GetAudit(ctx, models.AuditQuery{Limit: 1000})
+			require.NoError(t, err)
+
+			var registered, unknownFailure, lockout bool
+			for _, e := range entries {
+				for _, raw := range [][]byte{e.Before, e.After, e.Details} {
+					assert.NotContains(t, string(raw), known, e.Action)
+					assert.NotContains(t, string(raw), unknown, e.Action)
+				}
+				switch {
+				case e.Action == models.AuditUserRegister && e.TargetUID == user.UID:
+					registered = true
+				case e.Action == models.AuditLoginFailure && strings.Contains(string(e.Details), srvc.loginHash(unknown)):
+					unknownFailure = true
+				case e.Action == models.AuditLoginLockout && strings.Contains(string(e.Details), "login:"+srvc.loginHash(known)):
+					lockout = true
+				}
+			}
+			assert.True(t, registered, "registration is recorded by uid")
+			assert.True(t, unknownFailure, "failure on an unknown login is recorded by hash")
+			assert.True(t, lockout, "lockout is recorded by hash")
+
+			// the hash follows login normalization and depends on the key
+			assert.Equal(t, srvc.loginHash(unknown), srvc.loginHash(" "+strings.ToUpper(unknown)))
+			assert.NotEqual(t, srvc.loginHash(unknown), testService(t, storage).loginHash(unknown))
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// HealthLimits decide when gophermart stops being ready. The accrual system is
+// unhealthy when queued orders wait and no call succeeded for AccrualStale,
+// the queue is unhealthy when it grows over MaxQueue. Zero disables a check.
+type HealthLimits struct {
+	AccrualStale time.Duration
+	MaxQueue     int
+}
+
+// health keeps what the readiness check cannot ask the storage about
+type health struct {
+	started     time.Time
+	lastAccrual atomic.Int64 // unix nanoseconds of the last successful accrual call
+	draining    atomic.Bool
+}
+
+func (h *health) accrualSucceeded() {
+	h.lastAccrual.Store(time.Now().UnixNano())
+}
+
+// Drain makes readiness fail, called when the graceful shutdown starts
+func (s *Service) Drain() {
+	s.health.draining.Store(true)
+}
+
+// Ready checks every component gophermart needs to serve requests
+func (s *Service) Ready(ctx context.Context) models.HealthResponse {
+	resp := models.HealthResponse{
+		Status:     models.HealthOK,
+		Components: make(map[string]models.ComponentHealth),
+	}
+	check := func(name string, c models.ComponentHealth) {
+		if c.Status != models.HealthOK {
+			resp.Status = models.HealthFail
+		}
+		resp.Components[name] = c
+	}
+
+	shutdown := models.ComponentHealth{Status: models.HealthOK}
+	if s.health.draining.Load() {
+		shutdown = models.ComponentHealth{Status: models.HealthFail, Error: "shutting down"}
+	}
+	check("shutdown", shutdown)
+
+	db := models.ComponentHealth{Status: models.HealthOK}
+	if err := s.storage.Ping(ctx); err != nil {
+		db = models.ComponentHealth{Status: models.HealthFail, Error: err.Error()}
+	}
+	check("database", db)
+
+	depth, err := s.storage.AccrualQueueDepth(ctx)
+	queue := models.ComponentHealth{Status: models.HealthOK, QueueDepth: &depth}
+	switch {
+	case err != nil:
+		queue = models.ComponentHealth{Status: models.HealthFail, Error: err.Error()}
+	case s.healthLimits.MaxQueue > 0 && depth > s.healthLimits.MaxQueue:
+		queue.Status = models.HealthFail
+		queue.Error = "accrual queue is too long"
+	}
+	check("accrual_queue", queue)
+
+	accrual := models.ComponentHealth{Status: models.HealthOK}
+	last := s.health.started
+	if nanos := s.health.lastAccrual.Load(); nanos > 0 {
+		last = time.Unix(0, nanos)
+		accrual.LastSuccess = &last
+	}
+	// an empty queue needs no calls, so a quiet accrual system is fine then
+	if s.healthLimits.AccrualStale > 0 && depth > 0 && time.Since(last) > s.healthLimits.AccrualStale {
+		accrual.Status = models.HealthFail
+		accrual.Error = "no successful accrual call in " + s.healthLimits.AccrualStale.String()
+	}
+	check("accrual", accrual)
+
+	return resp
+}
@@ -4,114 +4,312 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
-	log "github.com/go-pkgz/lgr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/stsg/gophermart/cmd/gophermart/metrics"
 	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
 )
 
+const (
+	jobIdleInterval = 1 * time.Second  // how long a worker sleeps when the queue is empty
+	jobLease        = 30 * time.Second // how long a claimed job is hidden from other workers
+	jobPollInterval = 1 * time.Second  // first delay between polls of an order still being processed
+	jobMaxPoll      = 30 * time.Second // longest delay between polls of the same order
+	jobMaxBackoff   = 1 * time.Minute
+	limiterMaxWait  = 5 * time.Second // longest a claimed job waits for the limiter, well inside jobLease
+	accrualTimeout  = 5 * time.Second
+)
+
+var errAccrualThrottled = errors.New("accrual system throttled requests")
+
+// SendToAccrual registers queued orders in the accrual system
 func (s *Service) SendToAccrual(ctx context.Context) {
-	log.Printf("[INFO] SendToAccrual")
-	for {
-		log.Print("[INFO] waiting for ChanToAccurual")
-		order := <-s.ChanToAccurual
-		log.Print("[INFO] received from ChanToAccurual")
-
-		// url, err := url.Parse("http://" + s.accrualAddress + "/api/orders")
-		url, err := url.Parse(s.accrualAddress + "/api/orders")
-		if err != nil {
-			log.Printf("[ERROR] accrualAddress invalid %v", err)
-		}
+	slog.InfoContext(ctx, "SendToAccrual", "workers", s.workers)
+	s.runPool(ctx, models.AccrualJobRegister, s.registerOrder)
+}
 
-		body := fmt.Sprintf(`{"order": "%s"}`, order.ID)
-		jsonBody := []byte(body)
-		req := bytes.NewReader(jsonBody)
-		resp, err := http.Post(url.String(), "application/json", req)
-		if err != nil {
-			s.ChanToAccurual <- order
-			log.Printf("[ERROR] cant get accrual %v", err)
-		}
+// RecieveFromAccrual polls the accrual system for registered orders
+func (s *Service) RecieveFromAccrual(ctx context.Context) {
+	slog.InfoContext(ctx, "RecieveFromAccrual", "workers", s.workers)
+	s.runPool(ctx, models.AccrualJobPoll, s.pollOrder)
+}
 
-		if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusConflict {
-			order, _ = s.storage.UpdateOrderStatus(ctx, order.ID, models.AccrualStatusProcessing, 0)
-			log.Print("[INFO] trying sending to ChanFromAccurual")
-			s.ChanFromAccurual <- order
-			log.Print("[INFO] sent to ChanFromAccurual")
-		} else {
-			log.Print("[INFO] trying sending ChanToAccurual")
-			s.ChanToAccurual <- order
-			log.Print("[INFO] sent to ChanToAccurual")
+// runPool runs the configured number of workers on the stage until ctx is done
+func (s *Service) runPool(ctx context.Context, stage models.AccrualJobStage, handle func(context.Context, models.AccrualJob)) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runJobs(ctx, stage, handle)
+		}()
+	}
+	wg.Wait()
+}
 
+// runJobs claims and handles jobs until ctx is done. The job in hand is
+// finished on a context of its own, so shutdown does not cut it in the middle;
+// jobs left unfinished stay in the queue and are claimed again after the lease.
+func (s *Service) runJobs(ctx context.Context, stage models.AccrualJobStage, handle func(context.Context, models.AccrualJob)) {
+	for ctx.Err() == nil {
+		// jobs are not claimed while the accrual system pauses us, a claimed job
+		// waiting out a long Retry-After would outlive its lease and be claimed twice
+		if d := s.limiter.Delay(); d > limiterMaxWait {
+			if !sleep(ctx, d) {
+				return
+			}
+			continue
 		}
-		err = resp.Body.Close()
+
+		job, err := s.storage.ClaimAccrualJob(ctx, stage, jobLease)
 		if err != nil {
-			log.Printf("[ERROR] cant close request body %v", err)
+			if !errors.Is(err, models.ErrJobNotFound) && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "cannot claim accrual job", "stage", stage, "err", err)
+			}
+			if !sleep(ctx, jobIdleInterval) {
+				return
+			}
+			continue
 		}
+
+		slog.DebugContext(ctx, "claimed accrual job", "stage", stage, "order", job.OrderID, "attempt", job.Attempts)
+		jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jobLease)
+		jobCtx, span := s.jobSpan(jobCtx, job)
+		handle(jobCtx, job)
+		span.End()
+		cancel()
 	}
 }
 
-func (s *Service) RecieveFromAccrual(ctx context.Context) {
-	log.Printf("[INFO] RecieveFromAccrual")
-	for {
-		log.Print("[INFO] waiting for ChanFromAccurual")
-		order := <-s.ChanFromAccurual
-		log.Print("[INFO] received from ChanFromAccurual")
-		url, err := url.Parse(fmt.Sprintf(s.accrualAddress+"/api/orders/%s", order.ID))
-		if err != nil {
-			log.Printf("[ERROR] accrualAddress invalid %v", err)
-		}
+// jobSpan starts the root span of a job attempt, linked to the request that queued the job
+func (s *Service) jobSpan(ctx context.Context, job models.AccrualJob) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithAttributes(
+			attribute.String("order.number", job.OrderID),
+			attribute.Int("job.attempt", job.Attempts),
+		),
+	}
+	if job.TraceParent != "" {
+		opts = append(opts, trace.WithLinks(tracing.Link(job.TraceParent)))
+	}
+	return tracing.Start(ctx, "accrual "+strings.ToLower(string(job.Stage)), opts...)
+}
 
-		resp, err := http.Get(url.String())
-		if err != nil {
-			log.Printf("[ERROR] cant get accrual %v", err)
-		}
+func (s *Service) registerOrder(ctx context.Context, job models.AccrualJob) {
+	url, err := url.JoinPath(s.accrualAddress, "/api/orders")
+	if err != nil {
+		slog.ErrorContext(ctx, "accrualAddress invalid", "err", err)
+		s.retryJob(ctx, job, err)
+		return
+	}
+
+	body := fmt.Sprintf(`{"order": "%s"}`, job.OrderID)
+	resp, err := s.accrualDo(ctx, http.MethodPost, url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		slog.ErrorContext(ctx, "cant register order in accrual", "order", job.OrderID, "err", err)
+		s.retryJob(ctx, job, err)
+		return
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusConflict {
+		s.retryJob(ctx, job, fmt.Errorf("unexpected accrual status %d", resp.StatusCode))
+		return
+	}
+
+	_, err = s.storage.UpdateOrderStatus(ctx, job.OrderID, models.AccrualStatusProcessing, 0)
+	if errors.Is(err, models.ErrOrderStatusTransition) {
+		s.completeJob(ctx, job)
+		return
+	}
+	if err != nil {
+		s.retryJob(ctx, job, err)
+		return
+	}
+
+	err = s.storage.RescheduleAccrualJob(ctx, job.OrderID, models.AccrualJobPoll, 0, "")
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot move accrual job to polling", "order", job.OrderID, "err", err)
+	}
+}
+
+func (s *Service) pollOrder(ctx context.Context, job models.AccrualJob) {
+	url, err := url.JoinPath(s.accrualAddress, "/api/orders", job.OrderID)
+	if err != nil {
+		slog.ErrorContext(ctx, "accrualAddress invalid", "err", err)
+		s.retryJob(ctx, job, err)
+		return
+	}
 
-		body, err := io.ReadAll(resp.Body)
+	resp, err := s.accrualDo(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "cant get accrual", "err", err)
+		s.retryJob(ctx, job, err)
+		return
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode == http.StatusNoContent {
+		// the accrual system does not know the order, register it once more
+		slog.WarnContext(ctx, "order is not registered in accrual, resubmitting", "order", job.OrderID)
+		err = s.storage.RescheduleAccrualJob(ctx, job.OrderID, models.AccrualJobRegister, 0, "order not registered")
 		if err != nil {
-			log.Printf("[ERROR] cannot get body %v", err)
+			slog.ErrorContext(ctx, "cannot move accrual job to registration", "order", job.OrderID, "err", err)
 		}
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		s.retryJob(ctx, job, fmt.Errorf("unexpected accrual status %d", resp.StatusCode))
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get body", "err", err)
+		s.retryJob(ctx, job, err)
+		return
+	}
+
+	accrual := &models.AccrualResponse{}
+	err = json.Unmarshal(body, accrual)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot unmarshal body", "err", err)
+		s.retryJob(ctx, job, err)
+		return
+	}
 
-		accrual := &models.AccrualResponse{}
-		err = json.Unmarshal(body, accrual)
+	status := accrual.Status.OrderStatus()
+	switch {
+	case status == "":
+		s.retryJob(ctx, job, fmt.Errorf("unknown accrual status %q", accrual.Status))
+		return
+	case !status.IsFinal():
+		err = s.storage.RescheduleAccrualJob(ctx, job.OrderID, job.Stage, pollDelay(job.Attempts), "")
 		if err != nil {
-			log.Printf("[ERROR] cannot unmarshal body %v", err)
+			slog.ErrorContext(ctx, "cannot reschedule accrual job", "order", job.OrderID, "err", err)
 		}
+		return
+	}
 
-		if resp.StatusCode == http.StatusOK && accrual.Status == models.AccrualStatusProcessed {
-			_, err := s.storage.UpdateOrderStatus(ctx, order.ID, models.AccrualStatusProcessed, int64(accrual.Accrual*100.00))
-			if err != nil {
-				return
-			}
-		}
-		err = resp.Body.Close()
+	var amount models.Money
+	if status == models.AccrualStatusProcessed {
+		amount = accrual.Accrual
+	}
+
+	_, err = s.storage.UpdateOrderStatus(ctx, job.OrderID, status, amount)
+	if err != nil && !errors.Is(err, models.ErrOrderStatusTransition) {
+		s.retryJob(ctx, job, err)
+		return
+	}
+
+	slog.InfoContext(ctx, "order status updated from accrual", "order", job.OrderID, "status", status)
+	s.completeJob(ctx, job)
+}
+
+// completeJob drops the job of an order which reached a final status
+func (s *Service) completeJob(ctx context.Context, job models.AccrualJob) {
+	err := s.storage.CompleteAccrualJob(ctx, job.OrderID)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot complete accrual job", "order", job.OrderID, "err", err)
+	}
+}
+
+// accrualDo sends a request to the accrual system through the shared limiter.
+// A 429 answer pauses every worker and is returned as errAccrualThrottled.
+func (s *Service) accrualDo(ctx context.Context, method, url string, body io.Reader) (*http.Response, error) {
+	if err := s.limiter.Wait(ctx, limiterMaxWait); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		metrics.ObserveAccrual(method, 0, time.Since(start))
+		return nil, err
+	}
+	metrics.ObserveAccrual(method, resp.StatusCode, time.Since(start))
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		defer closeBody(resp)
+		hint, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Printf("[ERROR] cant close request body %v", err)
+			slog.ErrorContext(ctx, "cannot get body", "err", err)
 		}
+		s.limiter.Throttle(parseRetryAfter(resp.Header.Get("Retry-After")), parseRateHint(hint))
+		return nil, errAccrualThrottled
+	}
+	if resp.StatusCode < http.StatusInternalServerError {
+		s.health.accrualSucceeded()
 	}
+
+	return resp, nil
 }
 
-func (s *Service) ProcessOrders(ctx context.Context) {
-	log.Printf("[INFO] ProcessOrders")
+// retryJob puts the job back into its stage with a linear backoff by attempts,
+// throttled jobs come back right when the limiter lets requests through again
+func (s *Service) retryJob(ctx context.Context, job models.AccrualJob, jobErr error) {
+	delay := time.Duration(job.Attempts) * time.Second
+	if delay > jobMaxBackoff {
+		delay = jobMaxBackoff
+	}
+	if errors.Is(jobErr, errAccrualThrottled) {
+		delay = s.limiter.Delay()
+	}
 
-	newOrders, err := s.storage.GetOrdersByStatus(ctx, models.AccrualStatusNew)
+	slog.WarnContext(ctx, "accrual job failed, will retry", "stage", job.Stage, "order", job.OrderID, "delay", delay, "err", jobErr)
+	err := s.storage.RescheduleAccrualJob(ctx, job.OrderID, job.Stage, delay, jobErr.Error())
 	if err != nil {
-		log.Printf("[ERROR] cannot get new orders %v", err)
+		slog.ErrorContext(ctx, "cannot reschedule accrual job", "order", job.OrderID, "err", err)
 	}
+}
 
-	processingOrders, err := s.storage.GetOrdersByStatus(ctx, models.AccrualStatusProcessing)
-	if err != nil {
-		log.Printf("[ERROR] cannot get processing orders %v", err)
+// pollDelay doubles the pause between polls of the same order up to jobMaxPoll
+func pollDelay(attempts int) time.Duration {
+	delay := jobPollInterval
+	for i := 1; i < attempts && delay < jobMaxPoll; i++ {
+		delay *= 2
+	}
+	if delay > jobMaxPoll {
+		delay = jobMaxPoll
 	}
+	return delay
+}
 
-	for _, order := range newOrders {
-		s.ChanToAccurual <- order
+func closeBody(resp *http.Response) {
+	err := resp.Body.Close()
+	if err != nil {
+		slog.Error("cant close request body", "err", err)
 	}
+}
 
-	for _, order := range processingOrders {
-		s.ChanFromAccurual <- order
+// sleep waits for d, returns false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
 	}
 }
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is used when the accrual system answers 429 without a usable Retry-After
+const defaultRetryAfter = 60 * time.Second
+
+var reRateHint = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+// accrualLimiter is shared by all accrual workers. It spaces requests by the rate
+// the accrual system advertised and holds every worker while it answers 429.
+type accrualLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration // minimal gap between requests, zero means unlimited
+	next       time.Time     // earliest time the next request may start
+	pausedTill time.Time
+}
+
+// Wait blocks until the caller may send the next request to the accrual system.
+// If that is more than maxWait away it returns errAccrualThrottled at once and
+// the caller gives the job back instead of holding it past its lease.
+func (l *accrualLimiter) Wait(ctx context.Context, maxWait time.Duration) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.nextAt(now)
+	if at.Sub(now) > maxWait {
+		l.mu.Unlock()
+		return errAccrualThrottled
+	}
+	if at.After(now) {
+		slog.DebugContext(ctx, "accrual requests paused", "wait", at.Sub(now).Round(time.Millisecond))
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	if at.After(now) && !sleep(ctx, at.Sub(now)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Throttle pauses all requests for retryAfter and, if the accrual system told
+// its limit, keeps requests at that rate afterwards
+func (l *accrualLimiter) Throttle(retryAfter time.Duration, perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pausedTill = time.Now().Add(retryAfter)
+	if perMinute > 0 {
+		l.interval = time.Minute / time.Duration(perMinute)
+	}
+
+	rate := "unlimited"
+	if l.interval > 0 {
+		rate = strconv.Itoa(int(time.Minute/l.interval)) + " rpm"
+	}
+	slog.Warn("accrual system throttled, all workers paused", "pause", retryAfter, "rate", rate)
+}
+
+// Delay returns how long until the next request may be sent, by the rate or by the last 429
+func (l *accrualLimiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	return l.nextAt(now).Sub(now)
+}
+
+// nextAt returns the earliest time a request may start, the caller must hold the lock
+func (l *accrualLimiter) nextAt(now time.Time) time.Time {
+	at := now
+	if l.next.After(at) {
+		at = l.next
+	}
+	if l.pausedTill.After(at) {
+		at = l.pausedTill
+	}
+	return at
+}
+
+// parseRetryAfter accepts both delay-seconds and HTTP-date forms of the header
+func parseRetryAfter(header string) time.Duration {
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+// parseRateHint extracts N from "No more than N requests per minute allowed", zero if absent
+func parseRateHint(body []byte) int {
+	m := reRateHint.FindSubmatch(body)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tbl := []struct {
+		name   string
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{name: "seconds", header: "120", min: 120 * time.Second, max: 120 * time.Second},
+		{name: "zero seconds", header: "0", min: 0, max: 0},
+		{name: "http date", header: time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat), min: 85 * time.Second, max: 90 * time.Second},
+		{name: "http date in the past", header: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), min: 0, max: 0},
+		{name: "empty", header: "", min: defaultRetryAfter, max: defaultRetryAfter},
+		{name: "negative", header: "-5", min: defaultRetryAfter, max: defaultRetryAfter},
+		{name: "garbage", header: "soon", min: defaultRetryAfter, max: defaultRetryAfter},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			d := parseRetryAfter(tt.header)
+			assert.GreaterOrEqual(t, d, tt.min)
+			assert.LessOrEqual(t, d, tt.max)
+		})
+	}
+}
+
+func TestParseRateHint(t *testing.T) {
+	tbl := []struct {
+		body string
+		want int
+	}{
+		{body: "No more than 10 requests per minute allowed", want: 10},
+		{body: "Too many requests. No more than 600 requests per minute allowed\n", want: 600},
+		{body: "No more than many requests per minute allowed", want: 0},
+		{body: "slow down", want: 0},
+		{body: "", want: 0},
+	}
+
+	for _, tt := range tbl {
+		assert.Equal(t, tt.want, parseRateHint([]byte(tt.body)), tt.body)
+	}
+}
+
+func TestAccrualLimiterWait(t *testing.T) {
+	var l accrualLimiter
+	require.NoError(t, l.Wait(context.Background(), time.Second))
+	assert.Zero(t, l.Delay())
+
+	// a pause longer than maxWait is not waited out, the job goes back to the queue
+	l.Throttle(time.Minute, 0)
+	start := time.Now()
+	assert.ErrorIs(t, l.Wait(context.Background(), time.Second), errAccrualThrottled)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Greater(t, l.Delay(), 59*time.Second)
+
+	// a short pause is waited out
+	l.Throttle(50*time.Millisecond, 0)
+	start = time.Now()
+	require.NoError(t, l.Wait(context.Background(), time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestAccrualLimiterRate(t *testing.T) {
+	var l accrualLimiter
+	l.Throttle(0, 600) // a request every 100ms
+
+	require.NoError(t, l.Wait(context.Background(), time.Second))
+	start := time.Now()
+	require.NoError(t, l.Wait(context.Background(), time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	// the slot after the next one is more than maxWait away
+	assert.ErrorIs(t, l.Wait(context.Background(), 50*time.Millisecond), errAccrualThrottled)
+}
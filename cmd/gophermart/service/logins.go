@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// lockoutDecay is how long after the last lockout its level is forgotten
+const lockoutDecay = 24 * time.Hour
+
+// LoginLimits throttles password guessing. After MaxFailures failed logins
+// within Window the login or the client address is locked out for Lockout,
+// every lockout in a row doubles it up to MaxLockout.
+type LoginLimits struct {
+	MaxFailures int
+	Window      time.Duration
+	Lockout     time.Duration
+	MaxLockout  time.Duration
+}
+
+func loginKeys(login, ip string) []string {
+	keys := []string{"login:" + login}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// resetKeys limit password reset requests apart from failed logins
+func resetKeys(login, ip string) []string {
+	keys := loginKeys(login, ip)
+	for i := range keys {
+		keys[i] = "reset:" + keys[i]
+	}
+	return keys
+}
+
+// auditLoginKey hides the login of a lockout key from the audit log
+func (s *Service) auditLoginKey(key string) string {
+	for _, prefix := range []string{"login:", "reset:login:"} {
+		if login, ok := strings.CutPrefix(key, prefix); ok {
+			return prefix + s.loginHash(login)
+		}
+	}
+	return key
+}
+
+// checkLockout returns LockoutError if any of the keys is locked out
+func (s *Service) checkLockout(ctx context.Context, keys []string) error {
+	if s.loginLimits.MaxFailures < 1 {
+		return nil
+	}
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		lockout, err := s.storage.GetLoginLockout(ctx, key)
+		if err != nil {
+			return err
+		}
+		if d := time.Until(lockout.LockedUntil); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return &models.LockoutError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// loginFailed counts the failure against every key and locks out the ones
+// over the limit, LockoutError is returned if that happened
+func (s *Service) loginFailed(ctx context.Context, keys []string) error {
+	if s.loginLimits.MaxFailures < 1 {
+		return nil
+	}
+
+	var retryAfter time.Duration
+	for _, key := range keys {
+		failures, err := s.storage.AddLoginFailure(ctx, key, s.loginLimits.Window)
+		if err != nil {
+			return err
+		}
+		if failures < s.loginLimits.MaxFailures {
+			continue
+		}
+
+		lockout, err := s.storage.GetLoginLockout(ctx, key)
+		if err != nil {
+			return err
+		}
+		if time.Since(lockout.LockedUntil) > lockoutDecay {
+			lockout.Level = 0
+		}
+		duration := s.loginLimits.lockout(lockout.Level)
+		lockout.Level++
+		lockout.LockedUntil = time.Now().Add(duration)
+
+		err = s.storage.SetLoginLockout(ctx, lockout)
+		if err != nil {
+			return err
+		}
+		slog.WarnContext(ctx, "locked out after failed logins",
+			"key", key, "duration", duration, "failures", failures, "level", lockout.Level)
+		s.audit(ctx, models.AuditEntry{
+			Action: models.AuditLoginLockout,
+			Details: models.AuditValues(map[string]interface{}{
+				"key": s.auditLoginKey(key), "failures": failures, "level": lockout.Level, "until": lockout.LockedUntil,
+			}),
+		})
+
+		if duration > retryAfter {
+			retryAfter = duration
+		}
+	}
+	if retryAfter > 0 {
+		return &models.LockoutError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// lockout returns the lockout duration for the given number of previous lockouts
+func (l LoginLimits) lockout(level int) time.Duration {
+	d := l.Lockout
+	for i := 0; i < level && d < l.MaxLockout; i++ {
+		d *= 2
+	}
+	if l.MaxLockout > 0 && d > l.MaxLockout {
+		d = l.MaxLockout
+	}
+	return d
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestLoginLimitsLockout(t *testing.T) {
+	l := LoginLimits{Lockout: time.Minute, MaxLockout: 10 * time.Minute}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for level, d := range want {
+		assert.Equal(t, d, l.lockout(level), "level %d", level)
+	}
+
+	unbounded := LoginLimits{Lockout: time.Minute}
+	assert.Equal(t, time.Minute, unbounded.lockout(3), "no doubling without MaxLockout")
+}
+
+// lockedFor returns how long err locks out, 0 if it is no LockoutError
+func lockedFor(err error) time.Duration {
+	var lockout *models.LockoutError
+	if errors.As(err, &lockout) {
+		return lockout.RetryAfter
+	}
+	return 0
+}
+
+func TestLoginLockoutEscalates(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			srvc.loginLimits = LoginLimits{
+				MaxFailures: 2,
+				Window:      time.Minute,
+				Lockout:     100 * time.Millisecond,
+				MaxLockout:  300 * time.Millisecond,
+			}
+			ctx := testContext(t)
+			login := "lockout-" + testOrderNumber()
+			_, err := srvc.Register(ctx, login, "Secret123")
+			require.NoError(t, err)
+
+			var until time.Time
+			for _, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond} {
+				time.Sleep(time.Until(until))
+
+				_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+				require.ErrorIs(t, err, models.ErrUserWrongPassword, "first failure only counts")
+				_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+				d := lockedFor(err)
+				require.InDelta(t, want, d, float64(20*time.Millisecond), "lockout doubles up to MaxLockout")
+				until = time.Now().Add(d)
+
+				// while locked out even the right password is refused
+				_, _, err = srvc.Login(ctx, login, "Secret123", "")
+				assert.Greater(t, lockedFor(err), time.Duration(0))
+			}
+
+			// the lockout expires, a successful login clears the failures and the level
+			time.Sleep(time.Until(until))
+			_, _, err = srvc.Login(ctx, login, "Secret123", "")
+			require.NoError(t, err)
+			_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+			assert.ErrorIs(t, err, models.ErrUserWrongPassword)
+			_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+			assert.InDelta(t, 100*time.Millisecond, lockedFor(err), float64(20*time.Millisecond), "level starts over")
+		})
+	}
+}
+
+func TestLoginLockoutWindow(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			srvc.loginLimits = LoginLimits{MaxFailures: 2, Window: 200 * time.Millisecond, Lockout: time.Minute}
+			ctx := testContext(t)
+			login := "window-" + testOrderNumber()
+			_, err := srvc.Register(ctx, login, "Secret123")
+			require.NoError(t, err)
+
+			// failures slide out of the window
+			_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+			require.ErrorIs(t, err, models.ErrUserWrongPassword)
+			time.Sleep(300 * time.Millisecond)
+			_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+			require.ErrorIs(t, err, models.ErrUserWrongPassword)
+			_, _, err = srvc.Login(ctx, login, "Wrong1234", "")
+			assert.Equal(t, time.Minute, lockedFor(err).Round(time.Second))
+		})
+	}
+}
+
+func TestLoginLockoutByAddress(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			srvc.loginLimits = LoginLimits{MaxFailures: 3, Window: time.Minute, Lockout: time.Minute}
+			ctx := testContext(t)
+			ip := "192.0.2." + testOrderNumber()[:2]
+
+			// one client guessing across logins is locked out by its address
+			for i := 0; i < 2; i++ {
+				_, _, err := srvc.Login(ctx, "spray-"+testOrderNumber(), "Secret123", ip)
+				require.ErrorIs(t, err, models.ErrUserNotFound)
+			}
+			_, _, err := srvc.Login(ctx, "spray-"+testOrderNumber(), "Secret123", ip)
+			assert.Greater(t, lockedFor(err), time.Duration(0))
+
+			login := "victim-" + testOrderNumber()
+			_, err = srvc.Register(ctx, login, "Secret123")
+			require.NoError(t, err)
+			_, _, err = srvc.Login(ctx, login, "Secret123", ip)
+			assert.Greater(t, lockedFor(err), time.Duration(0), "the address is locked for every login")
+			_, _, err = srvc.Login(ctx, login, "Secret123", "198.51.100.1")
+			assert.NoError(t, err, "other addresses are not")
+		})
+	}
+}
+
+func TestLoginLockoutDecay(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			srvc.loginLimits = LoginLimits{MaxFailures: 1, Window: time.Minute, Lockout: time.Minute, MaxLockout: time.Hour}
+			ctx := testContext(t)
+			login := "decay-" + testOrderNumber()
+
+			// a high level from a lockout that ended long ago is forgotten
+			require.NoError(t, storage.SetLoginLockout(ctx, models.LoginLockout{
+				Key:         "login:" + login,
+				Level:       5,
+				LockedUntil: time.Now().Add(-lockoutDecay - time.Hour),
+			}))
+			_, _, err := srvc.Login(ctx, login, "Secret123", "")
+			assert.Equal(t, time.Minute, lockedFor(err).Round(time.Second))
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/metrics"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+// Notifier delivers password reset tokens to users
+type Notifier interface {
+	PasswordReset(ctx context.Context, user models.User, token string, expiresAt time.Time) error
+}
+
+// ChangePassword replaces the password of the logged in user. All sessions of
+// the user are revoked, the caller gets a fresh token pair to go on with.
+func (s *Service) ChangePassword(ctx context.Context, user models.User, oldPassword, newPassword string) (models.TokenResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.ChangePassword")
+	defer span.End()
+
+	err := comparePassword(ctx, user, oldPassword)
+	if err != nil {
+		slog.ErrorContext(ctx, "wrong password", "login", user.Login, "err", err)
+		return models.TokenResponse{}, models.ErrUserWrongPassword
+	}
+
+	err = s.policy.validatePassword("new_password", user.Login, newPassword)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	passwordHash, err := s.hashPassword(ctx, newPassword)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	sids, err := s.storage.ChangePassword(ctx, user.UID, passwordHash)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+	s.audit(ctx, models.AuditEntry{Action: models.AuditPasswordChange, ActorUID: user.UID, TargetUID: user.UID})
+	s.revokeAll(ctx, user.UID, sids, "password change")
+	slog.InfoContext(ctx, "password changed, sessions revoked", "login", user.Login, "sessions", len(sids))
+
+	return s.issueTokens(ctx, user.UID)
+}
+
+// RequestPasswordReset sends a reset token to the user. Requests are limited
+// per login and client address like failed logins. Unknown logins and failures
+// past the limit are not reported, so the answer is the same for any login and
+// the endpoint cannot be used to find out registered ones.
+func (s *Service) RequestPasswordReset(ctx context.Context, login, ip string) error {
+	ctx, span := tracing.Start(ctx, "Service.RequestPasswordReset")
+	defer span.End()
+
+	keys := resetKeys(NormalizeLogin(login), ip)
+	err := s.checkLockout(ctx, keys)
+	if err != nil {
+		return err
+	}
+	// every request counts, not only failed ones
+	err = s.loginFailed(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	err = s.sendPasswordReset(ctx, login)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot send password reset", "err", err)
+	}
+	return nil
+}
+
+func (s *Service) sendPasswordReset(ctx context.Context, login string) error {
+	user, err := s.findUser(ctx, login)
+	if err != nil {
+		slog.WarnContext(ctx, "password reset for unknown login", "login", login)
+		return nil
+	}
+
+	token, hash, err := lib.NewOpaqueToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create reset token", "err", err)
+		return err
+	}
+
+	reset := models.PasswordReset{
+		TokenHash: hash,
+		UID:       user.UID,
+		ExpiresAt: time.Now().Add(s.resetTTL),
+	}
+	err = s.storage.CreatePasswordReset(ctx, reset)
+	if err != nil {
+		return err
+	}
+
+	return s.notifier.PasswordReset(ctx, user, token, reset.ExpiresAt)
+}
+
+// ConfirmPasswordReset sets the new password if the reset token is valid,
+// the token is used up and all sessions of the user are revoked
+func (s *Service) ConfirmPasswordReset(ctx context.Context, token, newPassword string) error {
+	ctx, span := tracing.Start(ctx, "Service.ConfirmPasswordReset")
+	defer span.End()
+
+	reset, err := s.storage.GetPasswordReset(ctx, lib.HashToken(token))
+	if err != nil {
+		return err
+	}
+
+	user, err := s.storage.GetUserByUUID(ctx, reset.UID)
+	if err != nil {
+		slog.ErrorContext(ctx, "user not found", "uid", reset.UID, "err", err)
+		return models.ErrUserNotFound
+	}
+
+	err = s.policy.validatePassword("new_password", user.Login, newPassword)
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := s.hashPassword(ctx, newPassword)
+	if err != nil {
+		return err
+	}
+
+	sids, err := s.storage.ResetPassword(ctx, reset.TokenHash, passwordHash)
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, models.AuditEntry{Action: models.AuditPasswordReset, TargetUID: user.UID})
+	s.revokeAll(ctx, user.UID, sids, "password reset")
+	slog.InfoContext(ctx, "password reset, sessions revoked", "login", user.Login, "sessions", len(sids))
+
+	return nil
+}
+
+func (s *Service) hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Start(ctx, "bcrypt.hash", trace.WithAttributes(attribute.Int("bcrypt.cost", s.bcryptCost)))
+	defer span.End()
+
+	start := time.Now()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), s.bcryptCost)
+	metrics.ObserveBcrypt("hash", time.Since(start))
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot generate password hash", "err", err)
+		return "", err
+	}
+	return string(passwordHash), nil
+}
+
+// comparePassword checks the password against the user's hash
+func comparePassword(ctx context.Context, user models.User, password string) error {
+	_, span := tracing.Start(ctx, "bcrypt.compare")
+	defer span.End()
+
+	start := time.Now()
+	err := bcrypt.CompareHashAndPassword([]byte(user.PHash), []byte(password))
+	metrics.ObserveBcrypt("compare", time.Since(start))
+	return err
+}
+
+// upgradePassword rehashes the password if its hash is cheaper than the configured cost,
+// failures are only logged as the login itself succeeded
+func (s *Service) upgradePassword(ctx context.Context, user models.User, password string) {
+	cost, err := bcrypt.Cost([]byte(user.PHash))
+	if err != nil || cost >= s.bcryptCost {
+		return
+	}
+
+	passwordHash, err := s.hashPassword(ctx, password)
+	if err != nil {
+		return
+	}
+	err = s.storage.UpdatePassword(ctx, user.UID, passwordHash)
+	if err != nil {
+		return
+	}
+	slog.InfoContext(ctx, "password rehashed", "login", user.Login, "from_cost", cost, "to_cost", s.bcryptCost)
+}
+
+// revokeAll drops the sessions the storage revoked from the cache and audits the revocation
+func (s *Service) revokeAll(ctx context.Context, uid uuid.UUID, sids []uuid.UUID, reason string) {
+	for _, sid := range sids {
+		s.revoked.set(sid, true)
+	}
+	if len(sids) > 0 {
+		s.audit(ctx, models.AuditEntry{
+			Action:    models.AuditTokenRevoke,
+			TargetUID: uid,
+			Details:   models.AuditValues(map[string]interface{}{"sessions": sids, "reason": reason}),
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// testNotifier keeps the reset tokens it was asked to send
+type testNotifier struct {
+	mu     sync.Mutex
+	tokens map[string][]string
+	err    error
+}
+
+func (n *testNotifier) PasswordReset(_ context.Context, user models.User, token string, _ time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	if n.tokens == nil {
+		n.tokens = map[string][]string{}
+	}
+	n.tokens[user.Login] = append(n.tokens[user.Login], token)
+	return nil
+}
+
+func (n *testNotifier) sent(login string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.tokens[login]
+}
+
+func TestRequestPasswordResetLimited(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			notifier := &testNotifier{}
+			srvc.notifier = notifier
+			srvc.loginLimits = LoginLimits{MaxFailures: 3, Window: time.Minute, Lockout: time.Minute}
+			ctx := testContext(t)
+
+			known := "reset-" + testOrderNumber()
+			unknown := "nobody-" + testOrderNumber()
+			_, err := srvc.Register(ctx, known, "Secret123")
+			require.NoError(t, err)
+
+			// known and unknown logins get the same answers
+			for _, login := range []string{known, unknown} {
+				for i := 0; i < 2; i++ {
+					assert.NoError(t, srvc.RequestPasswordReset(ctx, login, ""), login)
+				}
+				err = srvc.RequestPasswordReset(ctx, login, "")
+				assert.Equal(t, time.Minute, lockedFor(err).Round(time.Second), login)
+				err = srvc.RequestPasswordReset(ctx, login, "")
+				assert.Greater(t, lockedFor(err), time.Duration(0), login)
+			}
+			assert.Len(t, notifier.sent(known), 2, "no tokens past the limit")
+
+			// failed logins and reset requests are counted apart
+			_, _, err = srvc.Login(ctx, known, "Secret123", "")
+			assert.NoError(t, err)
+
+			// a token sent within the limit still works
+			require.NoError(t, srvc.ConfirmPasswordReset(ctx, notifier.sent(known)[1], "NewSecret456"))
+			_, _, err = srvc.Login(ctx, known, "NewSecret456", "")
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRequestPasswordResetByAddress(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			notifier := &testNotifier{}
+			srvc.notifier = notifier
+			srvc.loginLimits = LoginLimits{MaxFailures: 3, Window: time.Minute, Lockout: time.Minute}
+			ctx := testContext(t)
+			ip := "203.0.113." + testOrderNumber()[:2]
+
+			victim := "victim-" + testOrderNumber()
+			_, err := srvc.Register(ctx, victim, "Secret123")
+			require.NoError(t, err)
+
+			// one client flooding many logins is stopped by its address
+			for i := 0; i < 2; i++ {
+				require.NoError(t, srvc.RequestPasswordReset(ctx, "flood-"+testOrderNumber(), ip))
+			}
+			err = srvc.RequestPasswordReset(ctx, victim, ip)
+			assert.Greater(t, lockedFor(err), time.Duration(0))
+			assert.Empty(t, notifier.sent(victim))
+
+			assert.NoError(t, srvc.RequestPasswordReset(ctx, victim, "198.51.100.7"))
+			assert.Len(t, notifier.sent(victim), 1)
+		})
+	}
+}
+
+func TestRequestPasswordResetNotifierFails(t *testing.T) {
+	storage := testStorages(t)["memory"]
+	srvc := testService(t, storage)
+	srvc.notifier = &testNotifier{err: errors.New("smtp down")}
+	ctx := testContext(t)
+
+	login := "reset-" + testOrderNumber()
+	_, err := srvc.Register(ctx, login, "Secret123")
+	require.NoError(t, err)
+
+	// a failure to send must not tell a registered login from an unknown one
+	assert.NoError(t, srvc.RequestPasswordReset(ctx, login, ""))
+	assert.NoError(t, srvc.RequestPasswordReset(ctx, "nobody-"+testOrderNumber(), ""))
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// bcrypt ignores everything past 72 bytes
+const maxPasswordBytes = 72
+
+// loginSpecials are the characters allowed in logins besides letters and digits
+const loginSpecials = "._-@"
+
+// Policy is the set of rules new logins and passwords must follow
+type Policy struct {
+	LoginMinLen      int
+	LoginMaxLen      int
+	PasswordMinLen   int
+	PasswordClasses  int                 // lower, upper, digit and other characters the password mixes at least
+	BreachedPassword map[string]struct{} // known leaked passwords, lower case
+}
+
+// LoadBreachedPasswords reads a password per line, empty lines are skipped
+func LoadBreachedPasswords(path string) (map[string]struct{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read breached passwords file: %w", err)
+	}
+
+	passwords := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		password := strings.TrimSpace(scanner.Text())
+		if password != "" {
+			passwords[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return passwords, scanner.Err()
+}
+
+// NormalizeLogin trims, NFKC-normalizes and case-folds the login,
+// logins that differ only in these are the same login
+func NormalizeLogin(login string) string {
+	return cases.Fold().String(norm.NFKC.String(strings.TrimSpace(login)))
+}
+
+// validateRegistration checks the normalized login and the password against
+// the policy and returns ValidationError listing every broken rule
+func (p Policy) validateRegistration(login, password string) error {
+	var violations []models.Violation
+
+	switch n := utf8.RuneCountInString(login); {
+	case n == 0:
+		violations = append(violations, violation("login", "required", "login is required"))
+	case n < p.LoginMinLen || (p.LoginMaxLen > 0 && n > p.LoginMaxLen):
+		violations = append(violations, violation("login", "length", "login must be %d to %d characters long", p.LoginMinLen, p.LoginMaxLen))
+	}
+	for _, r := range login {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(loginSpecials, r) {
+			violations = append(violations, violation("login", "charset", "login may contain only letters, digits and %q", loginSpecials))
+			break
+		}
+	}
+
+	violations = append(violations, p.passwordViolations("password", login, password)...)
+	if len(violations) > 0 {
+		return &models.ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// validatePassword checks a new password of the existing login, field names it in violations
+func (p Policy) validatePassword(field, login, password string) error {
+	if violations := p.passwordViolations(field, login, password); len(violations) > 0 {
+		return &models.ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func (p Policy) passwordViolations(field, login, password string) []models.Violation {
+	var violations []models.Violation
+
+	if password == "" {
+		return append(violations, violation(field, "required", "password is required"))
+	}
+	if utf8.RuneCountInString(password) < p.PasswordMinLen {
+		violations = append(violations, violation(field, "length", "password must be at least %d characters long", p.PasswordMinLen))
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, violation(field, "length", "password must be at most %d bytes long", maxPasswordBytes))
+	}
+	if classes := passwordClasses(password); classes < p.PasswordClasses {
+		violations = append(violations, violation(field, "strength", "password must mix at least %d of lower case, upper case, digits and other characters", p.PasswordClasses))
+	}
+	if login != "" && strings.Contains(NormalizeLogin(password), NormalizeLogin(login)) {
+		violations = append(violations, violation(field, "login", "password must not contain the login"))
+	}
+	if _, ok := p.BreachedPassword[strings.ToLower(password)]; ok {
+		violations = append(violations, violation(field, "breached", "password is known to be leaked"))
+	}
+	return violations
+}
+
+func violation(field, rule, format string, args ...interface{}) models.Violation {
+	return models.Violation{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)}
+}
+
+// validateLogin rejects login requests that cannot be right without looking them up
+func validateLogin(login, password string) error {
+	var violations []models.Violation
+	if login == "" {
+		violations = append(violations, violation("login", "required", "login is required"))
+	}
+	if password == "" {
+		violations = append(violations, violation("password", "required", "password is required"))
+	}
+	if len(violations) > 0 {
+		return &models.ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestNormalizeLogin(t *testing.T) {
+	tbl := []struct {
+		name  string
+		login string
+		want  string
+	}{
+		{name: "case", login: "Alice", want: "alice"},
+		{name: "upper case", login: "ALICE", want: "alice"},
+		{name: "surrounding spaces", login: "  alice\t", want: "alice"},
+		{name: "fullwidth letters", login: "ａｌｉｃｅ", want: "alice"},
+		{name: "ligature", login: "ﬁona", want: "fiona"},
+		{name: "mathematical bold", login: "𝐚𝐥𝐢𝐜𝐞", want: "alice"},
+		{name: "superscript digit", login: "bob²", want: "bob2"},
+		{name: "sharp s", login: "STRASSE", want: "strasse"},
+		{name: "composed and decomposed accent", login: "josé", want: "josé"},
+		{name: "greek final sigma", login: "ΟΔΥΣΣΕΥΣ", want: "οδυσσευσ"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, NormalizeLogin(tt.login))
+		})
+	}
+
+	// visually different spellings of one login are the same login
+	assert.Equal(t, NormalizeLogin("Straße"), NormalizeLogin("STRASSE"))
+	assert.Equal(t, NormalizeLogin("José"), NormalizeLogin("JOSÉ"))
+	// look-alikes from other scripts are not folded and stay distinct logins
+	assert.NotEqual(t, NormalizeLogin("alice"), NormalizeLogin("аlice"), "cyrillic а")
+}
+
+func TestRegisterCollidingLogins(t *testing.T) {
+	srvc := testService(t, testStorages(t)["memory"])
+	ctx := testContext(t)
+
+	_, err := srvc.Register(ctx, "Alice.Smith", "Secret123")
+	require.NoError(t, err)
+
+	for _, login := range []string{"alice.smith", "ALICE.SMITH", " Alice.Smith ", "ａｌｉｃｅ.ｓｍｉｔｈ"} {
+		_, err := srvc.Register(ctx, login, "Secret123")
+		assert.ErrorIs(t, err, models.ErrUserExists, login)
+	}
+
+	// the user logs in with any spelling
+	_, _, err = srvc.Login(ctx, "ＡＬＩＣＥ.smith", "Secret123", "")
+	assert.NoError(t, err)
+}
+
+func TestValidateRegistration(t *testing.T) {
+	policy := testPolicy
+	policy.BreachedPassword = map[string]struct{}{"password1": {}}
+
+	tbl := []struct {
+		name     string
+		login    string
+		password string
+		want     []models.Violation
+	}{
+		{name: "valid", login: "alice", password: "Secret123"},
+		{name: "empty", login: "", password: "", want: []models.Violation{
+			{Field: "login", Rule: "required"},
+			{Field: "password", Rule: "required"},
+		}},
+		{name: "short login", login: "al", password: "Secret123", want: []models.Violation{
+			{Field: "login", Rule: "length"},
+		}},
+		{name: "login charset", login: "al ice!", password: "Secret123", want: []models.Violation{
+			{Field: "login", Rule: "charset"},
+		}},
+		{name: "short password", login: "alice", password: "Sec1", want: []models.Violation{
+			{Field: "password", Rule: "length"},
+		}},
+		{name: "weak password", login: "alice", password: "secretsecret", want: []models.Violation{
+			{Field: "password", Rule: "strength"},
+		}},
+		{name: "password contains login", login: "alice", password: "ALICE-2024", want: []models.Violation{
+			{Field: "password", Rule: "login"},
+		}},
+		{name: "breached password", login: "alice", password: "Password1", want: []models.Violation{
+			{Field: "password", Rule: "breached"},
+		}},
+		{name: "password over bcrypt limit", login: "alice", password: "Aa1" + strings.Repeat("x", 70), want: []models.Violation{
+			{Field: "password", Rule: "length"},
+		}},
+		{name: "every rule at once", login: "a!", password: "a!", want: []models.Violation{
+			{Field: "login", Rule: "length"},
+			{Field: "login", Rule: "charset"},
+			{Field: "password", Rule: "length"},
+			{Field: "password", Rule: "login"},
+		}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.validateRegistration(tt.login, tt.password)
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, models.ErrValidation)
+			var verr *models.ValidationError
+			require.True(t, errors.As(err, &verr))
+			got := make([]models.Violation, 0, len(verr.Violations))
+			for _, v := range verr.Violations {
+				assert.NotEmpty(t, v.Message)
+				got = append(got, models.Violation{Field: v.Field, Rule: v.Rule})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
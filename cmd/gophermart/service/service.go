@@ -2,122 +2,349 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
-	log "github.com/go-pkgz/lgr"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/stsg/gophermart/cmd/gophermart/lib"
 	"github.com/stsg/gophermart/cmd/gophermart/models"
-	postgres "github.com/stsg/gophermart/cmd/gophermart/store"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
 )
 
 // ---------------------------------8<-----------------------------------
 // --------------------------------->8-----------------------------------
 
+// Storage is the persistence layer the Service works on,
+// implemented by the postgres and in-memory stores
+type Storage interface {
+	Close()
+	Ping(ctx context.Context) error
+
+	GetUserByLogin(ctx context.Context, login string) (models.User, error)
+	GetUserByUUID(ctx context.Context, uid uuid.UUID) (models.User, error)
+	CreateUser(ctx context.Context, user *models.User) (*models.User, error)
+	SaveOrder(ctx context.Context, user models.User, order models.Order) (models.Order, error)
+	GetOrders(ctx context.Context, uid uuid.UUID) ([]models.OrderResponse, error)
+	GetBalance(ctx context.Context, uid uuid.UUID) (models.BalanceResponse, error)
+	GetLedger(ctx context.Context, uid uuid.UUID, limit, offset int) ([]models.LedgerEntryResponse, error)
+	SaveWithdraw(ctx context.Context, user models.User, order models.Order) error
+	UpdateOrderStatus(ctx context.Context, orderNumber string, status models.AccrualStatus, amount models.Money) (models.OrderResponse, error)
+	GetWithdrawals(ctx context.Context, uid uuid.UUID) ([]models.WithdrawalsResponse, error)
+	GetOrdersByStatus(ctx context.Context, status models.AccrualStatus) ([]models.OrderResponse, error)
+
+	ClaimAccrualJob(ctx context.Context, stage models.AccrualJobStage, lease time.Duration) (models.AccrualJob, error)
+	RescheduleAccrualJob(ctx context.Context, orderID string, stage models.AccrualJobStage, delay time.Duration, lastError string) error
+	CompleteAccrualJob(ctx context.Context, orderID string) error
+	AccrualQueueDepth(ctx context.Context) (int, error)
+	Stats(ctx context.Context) (models.Stats, error)
+
+	CreateSession(ctx context.Context, session models.Session) error
+	RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (models.Session, error)
+	RevokeSession(ctx context.Context, sid uuid.UUID) error
+	IsSessionRevoked(ctx context.Context, sid uuid.UUID) (bool, error)
+
+	AddLoginFailure(ctx context.Context, key string, window time.Duration) (int, error)
+	GetLoginLockout(ctx context.Context, key string) (models.LoginLockout, error)
+	SetLoginLockout(ctx context.Context, lockout models.LoginLockout) error
+	ResetLoginFailures(ctx context.Context, key string) error
+
+	UpdatePassword(ctx context.Context, uid uuid.UUID, phash string) error
+	ChangePassword(ctx context.Context, uid uuid.UUID, phash string) ([]uuid.UUID, error)
+	CreatePasswordReset(ctx context.Context, reset models.PasswordReset) error
+	GetPasswordReset(ctx context.Context, hash string) (models.PasswordReset, error)
+	ResetPassword(ctx context.Context, hash, phash string) ([]uuid.UUID, error)
+
+	GetTOTP(ctx context.Context, uid uuid.UUID) (models.TOTP, error)
+	SaveTOTPSecret(ctx context.Context, uid uuid.UUID, secret string) error
+	ListTOTPSecrets(ctx context.Context) ([]models.TOTP, error)
+	ReplaceTOTPSecret(ctx context.Context, uid uuid.UUID, old, secret string) error
+	EnableTOTP(ctx context.Context, uid uuid.UUID, step int64, recoveryHashes []string) error
+	UseTOTPStep(ctx context.Context, uid uuid.UUID, step int64) error
+	UseRecoveryCode(ctx context.Context, uid uuid.UUID, hash string) error
+
+	DeleteUser(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error)
+	AnonymizeUsers(ctx context.Context, deletedBefore time.Time) (int, error)
+
+	SearchUsers(ctx context.Context, query string, limit, offset int) ([]models.UserSummary, error)
+	SetUserRole(ctx context.Context, uid uuid.UUID, role models.Role, audit models.AuditEntry) error
+	CountUsersByRole(ctx context.Context, role models.Role) (int, error)
+	RequeueAccrualJob(ctx context.Context, orderID string, audit models.AuditEntry) error
+	AdjustBalance(ctx context.Context, adj models.Adjustment, audit models.AuditEntry) error
+	AppendAudit(ctx context.Context, entry models.AuditEntry) error
+	GetAudit(ctx context.Context, query models.AuditQuery) ([]models.AuditEntry, error)
+}
+
+type Config struct {
+	AccrualAddress string
+	AccrualWorkers int
+	Keys           *lib.KeySet    // JWT signing and verification keys
+	TOTPBox        *lib.SecretBox // encrypts TOTP secrets at rest, nil keeps them as is, for in-memory storage only
+	AuditKey       []byte         // keys login hashes in the audit log, random if empty
+	AccessTTL      time.Duration  // access token lifetime
+	RefreshTTL     time.Duration  // refresh token lifetime, extended on every refresh
+	LoginLimits    LoginLimits
+	Policy         Policy
+	BcryptCost     int           // password hash cost, weaker hashes are upgraded on login
+	ResetTTL       time.Duration // password reset token lifetime
+	Notifier       Notifier
+	Retention      time.Duration // how long deleted accounts keep their login
+	HealthLimits   HealthLimits
+}
+
 type Service struct {
-	storage          *postgres.Storage
-	ChanToAccurual   chan models.OrderResponse
-	ChanFromAccurual chan models.OrderResponse
-	accrualAddress   string
+	storage        Storage
+	accrualAddress string
+	workers        int
+	keys           *lib.KeySet
+	totpBox        *lib.SecretBox
+	auditKey       []byte
+	client         *http.Client
+	limiter        *accrualLimiter
+	accessTTL      time.Duration
+	refreshTTL     time.Duration
+	revoked        *revocationCache
+	loginLimits    LoginLimits
+	policy         Policy
+	bcryptCost     int
+	resetTTL       time.Duration
+	notifier       Notifier
+	retention      time.Duration
+	healthLimits   HealthLimits
+	health         *health
 }
 
-func New(storage *postgres.Storage, accrualAddress string) *Service {
-	toAccurual := make(chan models.OrderResponse, 100)
-	fromAccurual := make(chan models.OrderResponse, 100)
+func New(storage Storage, cfg *Config) *Service {
+	workers := cfg.AccrualWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	bcryptCost := cfg.BcryptCost
+	if bcryptCost < bcrypt.MinCost {
+		bcryptCost = bcrypt.DefaultCost
+	}
+	auditKey := cfg.AuditKey
+	if len(auditKey) == 0 {
+		auditKey = make([]byte, 32)
+		if _, err := rand.Read(auditKey); err != nil {
+			panic(err)
+		}
+	}
 
 	return &Service{
-		storage:          storage,
-		ChanToAccurual:   toAccurual,
-		ChanFromAccurual: fromAccurual,
-		accrualAddress:   accrualAddress,
+		storage:        storage,
+		accrualAddress: cfg.AccrualAddress,
+		workers:        workers,
+		keys:           cfg.Keys,
+		totpBox:        cfg.TOTPBox,
+		auditKey:       auditKey,
+		client:         &http.Client{Timeout: accrualTimeout, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		limiter:        &accrualLimiter{},
+		accessTTL:      cfg.AccessTTL,
+		refreshTTL:     cfg.RefreshTTL,
+		revoked:        newRevocationCache(),
+		loginLimits:    cfg.LoginLimits,
+		policy:         cfg.Policy,
+		bcryptCost:     bcryptCost,
+		resetTTL:       cfg.ResetTTL,
+		notifier:       cfg.Notifier,
+		retention:      cfg.Retention,
+		healthLimits:   cfg.HealthLimits,
+		health:         &health{started: time.Now()},
 	}
 }
 
+// RunWorkers runs the accrual workers and the anonymizer until ctx is done,
+// it returns once all of them have stopped
+func (s *Service) RunWorkers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, run := range []func(context.Context){s.SendToAccrual, s.RecieveFromAccrual, s.AnonymizeDeleted} {
+		wg.Add(1)
+		go func(run func(context.Context)) {
+			defer wg.Done()
+			run(ctx)
+		}(run)
+	}
+	wg.Wait()
+	slog.InfoContext(ctx, "workers stopped")
+}
+
+// Stats counts the stored data for metrics
+func (s *Service) Stats(ctx context.Context) (models.Stats, error) {
+	return s.storage.Stats(ctx)
+}
+
+// JWKS returns the public keys other services verify gophermart tokens with
+func (s *Service) JWKS() lib.JWKS {
+	return s.keys.JWKS()
+}
+
 func (s *Service) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
 
 	user, err := s.storage.GetUserByLogin(ctx, login)
 
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
 		return models.User{}, models.ErrUserNotFound
 	}
 
 	return user, nil
 }
 
-func (s *Service) Login(ctx context.Context, login, password string) (string, error) {
+// Login checks the password of the user logging in from the ip address,
+// failures are throttled per login and per address. Users with 2FA get
+// a partial token instead of the token pair, see CompleteMFALogin.
+func (s *Service) Login(ctx context.Context, login, password, ip string) (models.TokenResponse, *models.MFAResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.Login")
+	defer span.End()
 
-	user, err := s.GetUserByLogin(ctx, login)
+	err := validateLogin(strings.TrimSpace(login), password)
 	if err != nil {
-		return "", err
+		return models.TokenResponse{}, nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PHash), []byte(password))
+	keys := loginKeys(NormalizeLogin(login), ip)
+	err = s.checkLockout(ctx, keys)
 	if err != nil {
-		log.Printf("[ERROR] user %s wrong password %v", login, err)
-		return "", models.ErrUserWrongPassword
+		return models.TokenResponse{}, nil, err
 	}
 
-	jwtString, err := lib.CreateJWT(user.UID)
+	user, err := s.findUser(ctx, login)
 	if err != nil {
-		log.Printf("[ERROR] failed to create JWT %v", err)
-		return "", err
+		s.audit(ctx, models.AuditEntry{
+			Action:  models.AuditLoginFailure,
+			Details: models.AuditValues(map[string]interface{}{"login_hash": s.loginHash(login), "reason": "unknown login"}),
+		})
+		if lerr := s.loginFailed(ctx, keys); lerr != nil {
+			return models.TokenResponse{}, nil, lerr
+		}
+		return models.TokenResponse{}, nil, err
 	}
 
-	return jwtString, nil
+	err = comparePassword(ctx, user, password)
+	if err != nil {
+		slog.ErrorContext(ctx, "wrong password", "login", login, "err", err)
+		s.audit(ctx, models.AuditEntry{
+			Action:    models.AuditLoginFailure,
+			TargetUID: user.UID,
+			Details:   models.AuditValues(map[string]interface{}{"reason": "wrong password"}),
+		})
+		if lerr := s.loginFailed(ctx, keys); lerr != nil {
+			return models.TokenResponse{}, nil, lerr
+		}
+		return models.TokenResponse{}, nil, models.ErrUserWrongPassword
+	}
+
+	err = s.storage.ResetLoginFailures(ctx, keys[0])
+	if err != nil {
+		return models.TokenResponse{}, nil, err
+	}
+	s.upgradePassword(ctx, user, password)
+
+	mfa, err := s.mfaChallenge(ctx, user)
+	if err != nil || mfa != nil {
+		return models.TokenResponse{}, mfa, err
+	}
+
+	tokens, err := s.issueTokens(ctx, user.UID)
+	if err != nil {
+		return tokens, nil, err
+	}
+	s.audit(ctx, models.AuditEntry{Action: models.AuditLoginSuccess, ActorUID: user.UID, TargetUID: user.UID})
+	return tokens, nil, nil
+}
+
+// findUser looks the login up normalized, then as is for accounts
+// registered before logins were normalized
+func (s *Service) findUser(ctx context.Context, login string) (models.User, error) {
+	normalized := NormalizeLogin(login)
+	user, err := s.GetUserByLogin(ctx, normalized)
+	if errors.Is(err, models.ErrUserNotFound) && normalized != strings.TrimSpace(login) {
+		user, err = s.GetUserByLogin(ctx, strings.TrimSpace(login))
+	}
+	return user, err
 }
 
-func (s *Service) GetUserByToken(ctx context.Context, token string) (models.User, error) {
+// GetUserByToken validates the access token and returns its user and session id
+func (s *Service) GetUserByToken(ctx context.Context, token string) (models.User, uuid.UUID, error) {
+	ctx, span := tracing.Start(ctx, "Service.GetUserByToken")
+	defer span.End()
 
-	userUUID, err := lib.CheckJWT(token)
-	if err != nil || userUUID == uuid.Nil {
-		log.Printf("[ERROR] invalid JWT %s", err)
-		return models.User{}, err
+	claims, err := lib.CheckJWT(s.keys, token)
+	if err != nil || claims.UserID == uuid.Nil || claims.MFA {
+		slog.ErrorContext(ctx, "invalid JWT", "err", err)
+		return models.User{}, uuid.Nil, models.ErrTokenInvalid
 	}
 
-	user, err := s.storage.GetUserByUUID(ctx, userUUID)
+	revoked, err := s.isRevoked(ctx, claims.SessionID)
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
-		return models.User{}, models.ErrUserNotFound
+		return models.User{}, uuid.Nil, err
+	}
+	if revoked {
+		slog.WarnContext(ctx, "JWT of revoked session", "sid", claims.SessionID)
+		return models.User{}, uuid.Nil, models.ErrTokenRevoked
 	}
 
-	return user, nil
+	user, err := s.storage.GetUserByUUID(ctx, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
+		return models.User{}, uuid.Nil, models.ErrUserNotFound
+	}
+
+	return user, claims.SessionID, nil
 }
 
-func (s *Service) Register(ctx context.Context, login, password string) (string, error) {
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func (s *Service) Register(ctx context.Context, login, password string) (models.TokenResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.Register")
+	defer span.End()
+
+	login = NormalizeLogin(login)
+	err := s.policy.validateRegistration(login, password)
 	if err != nil {
-		log.Printf("[ERROR] cannot generate passowrd hash %v", err)
-		return "", err
+		return models.TokenResponse{}, err
+	}
+
+	passwordHash, err := s.hashPassword(ctx, password)
+	if err != nil {
+		return models.TokenResponse{}, err
 	}
 
 	user := &models.User{
 		Login:    login,
-		PHash:    string(passwordHash),
+		PHash:    passwordHash,
 		UID:      uuid.New(),
 		JWTToken: "",
+		Role:     models.RoleUser,
 	}
 
 	user, err = s.storage.CreateUser(ctx, user)
 	if err != nil {
-		return "", err
-	}
-
-	jwtString, err := lib.CreateJWT(user.UID)
-	if err != nil {
-		log.Printf("[ERROR] failed to create JWT %v", err)
-		return "", err
+		return models.TokenResponse{}, err
 	}
+	s.audit(ctx, models.AuditEntry{
+		Action:    models.AuditUserRegister,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		After:     models.AuditValues(map[string]interface{}{"role": user.Role}),
+	})
 
-	return jwtString, nil
+	return s.issueTokens(ctx, user.UID)
 }
 
 func (s *Service) SaveOrder(ctx context.Context, login string, orderNum string) (order models.Order, err error) {
+	ctx, span := tracing.Start(ctx, "Service.SaveOrder")
+	defer span.End()
+
 	user, err := s.storage.GetUserByLogin(ctx, login)
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
 		return models.Order{}, models.ErrUserNotFound
 	}
 
@@ -129,7 +356,7 @@ func (s *Service) SaveOrder(ctx context.Context, login string, orderNum string)
 		UploadedAt:    time.Now(),
 	})
 	if err != nil {
-		log.Printf("[ERROR] cannot save order %s %v", user.Login, err)
+		slog.ErrorContext(ctx, "cannot save order", "login", user.Login, "err", err)
 		return order, err
 	}
 
@@ -137,27 +364,48 @@ func (s *Service) SaveOrder(ctx context.Context, login string, orderNum string)
 }
 
 func (s *Service) GetOrders(ctx context.Context, login string) ([]models.OrderResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.GetOrders")
+	defer span.End()
+
 	user, err := s.storage.GetUserByLogin(ctx, login)
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
 		return []models.OrderResponse{}, models.ErrUserNotFound
 	}
 	return s.storage.GetOrders(ctx, user.UID)
 }
 
 func (s *Service) GetBalance(ctx context.Context, login string) (models.BalanceResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBalance")
+	defer span.End()
+
 	user, err := s.storage.GetUserByLogin(ctx, login)
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
 		return models.BalanceResponse{}, models.ErrUserNotFound
 	}
 	return s.storage.GetBalance(ctx, user.UID)
 }
 
-func (s *Service) SaveWithdraw(ctx context.Context, login string, orderNum string, amount int64) (err error) {
+func (s *Service) GetBalanceHistory(ctx context.Context, login string, limit, offset int) ([]models.LedgerEntryResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBalanceHistory")
+	defer span.End()
+
 	user, err := s.storage.GetUserByLogin(ctx, login)
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
+		return nil, models.ErrUserNotFound
+	}
+	return s.storage.GetLedger(ctx, user.UID, limit, offset)
+}
+
+func (s *Service) SaveWithdraw(ctx context.Context, login string, orderNum string, amount models.Money) (err error) {
+	ctx, span := tracing.Start(ctx, "Service.SaveWithdraw")
+	defer span.End()
+
+	user, err := s.storage.GetUserByLogin(ctx, login)
+	if err != nil {
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
 		return models.ErrUserNotFound
 	}
 
@@ -169,7 +417,7 @@ func (s *Service) SaveWithdraw(ctx context.Context, login string, orderNum strin
 		UploadedAt:    time.Now(),
 	})
 	if err != nil {
-		log.Printf("[ERROR] cannot save withdraw %s %v", user.Login, err)
+		slog.ErrorContext(ctx, "cannot save withdrawal", "login", user.Login, "err", err)
 		return err
 	}
 
@@ -177,9 +425,12 @@ func (s *Service) SaveWithdraw(ctx context.Context, login string, orderNum strin
 }
 
 func (s *Service) GetWithdrawals(ctx context.Context, login string) ([]models.WithdrawalsResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.GetWithdrawals")
+	defer span.End()
+
 	user, err := s.storage.GetUserByLogin(ctx, login)
 	if err != nil {
-		log.Printf("[ERROR] user %s not found %v", user.Login, err)
+		slog.ErrorContext(ctx, "user not found", "login", user.Login, "err", err)
 		return nil, models.ErrUserNotFound
 	}
 
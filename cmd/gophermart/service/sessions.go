@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+const (
+	revocationCacheTTL  = 30 * time.Second
+	revocationCacheSize = 10000
+)
+
+// revocationCache remembers session revocation checks, so Authorize does not hit
+// the storage on every request. Revocations made by this replica apply at once,
+// the ones made by other replicas within revocationCacheTTL.
+type revocationCache struct {
+	mu      sync.Mutex
+	entries map[uuid.UUID]revocationEntry
+}
+
+type revocationEntry struct {
+	revoked   bool
+	checkedAt time.Time
+}
+
+func newRevocationCache() *revocationCache {
+	return &revocationCache{entries: make(map[uuid.UUID]revocationEntry)}
+}
+
+func (c *revocationCache) get(sid uuid.UUID) (revoked, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[sid]
+	if !ok || time.Since(entry.checkedAt) > revocationCacheTTL {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+func (c *revocationCache) set(sid uuid.UUID, revoked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= revocationCacheSize {
+		for k, entry := range c.entries {
+			if time.Since(entry.checkedAt) > revocationCacheTTL {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[sid] = revocationEntry{revoked: revoked, checkedAt: time.Now()}
+}
+
+// issueTokens starts a new session for the user
+func (s *Service) issueTokens(ctx context.Context, uid uuid.UUID) (models.TokenResponse, error) {
+	refresh, hash, err := lib.NewOpaqueToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create refresh token", "err", err)
+		return models.TokenResponse{}, err
+	}
+
+	session := models.Session{
+		ID:          uuid.New(),
+		UID:         uid,
+		RefreshHash: hash,
+		ExpiresAt:   time.Now().Add(s.refreshTTL),
+	}
+	err = s.storage.CreateSession(ctx, session)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	return s.tokens(session, refresh)
+}
+
+func (s *Service) tokens(session models.Session, refresh string) (models.TokenResponse, error) {
+	access, err := lib.CreateJWT(s.keys, session.UID, session.ID, s.accessTTL)
+	if err != nil {
+		slog.Error("failed to create JWT", "err", err)
+		return models.TokenResponse{}, err
+	}
+
+	return models.TokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(s.accessTTL.Seconds()),
+
+		RefreshExpiresIn: int64(time.Until(session.ExpiresAt).Seconds()),
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token pair,
+// the presented refresh token stops working
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (models.TokenResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.Refresh")
+	defer span.End()
+
+	if refreshToken == "" {
+		return models.TokenResponse{}, models.ErrTokenInvalid
+	}
+
+	refresh, hash, err := lib.NewOpaqueToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create refresh token", "err", err)
+		return models.TokenResponse{}, err
+	}
+
+	session, err := s.storage.RotateSession(ctx, lib.HashToken(refreshToken), hash, time.Now().Add(s.refreshTTL))
+	if err != nil {
+		if session.ID != uuid.Nil {
+			s.revoked.set(session.ID, true)
+			s.audit(ctx, models.AuditEntry{
+				Action:    models.AuditTokenRevoke,
+				TargetUID: session.UID,
+				Details:   models.AuditValues(map[string]interface{}{"session": session.ID, "reason": "refresh token reused"}),
+			})
+		}
+		return models.TokenResponse{}, err
+	}
+
+	return s.tokens(session, refresh)
+}
+
+// Logout revokes the session, both its access and refresh tokens stop working
+func (s *Service) Logout(ctx context.Context, user models.User, sid uuid.UUID) error {
+	ctx, span := tracing.Start(ctx, "Service.Logout")
+	defer span.End()
+
+	err := s.storage.RevokeSession(ctx, sid)
+	if err != nil {
+		return err
+	}
+	s.revoked.set(sid, true)
+	s.audit(ctx, models.AuditEntry{
+		Action:    models.AuditTokenRevoke,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		Details:   models.AuditValues(map[string]interface{}{"session": sid, "reason": "logout"}),
+	})
+	return nil
+}
+
+func (s *Service) isRevoked(ctx context.Context, sid uuid.UUID) (bool, error) {
+	if revoked, ok := s.revoked.get(sid); ok {
+		return revoked, nil
+	}
+
+	revoked, err := s.storage.IsSessionRevoked(ctx, sid)
+	if err != nil {
+		return false, err
+	}
+	s.revoked.set(sid, revoked)
+	return revoked, nil
+}
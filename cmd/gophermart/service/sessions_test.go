@@ -0,0 +1,139 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			ctx := testContext(t)
+
+			t0, err := srvc.Register(ctx, "reuse-"+testOrderNumber(), "Secret123")
+			require.NoError(t, err)
+			other, err := srvc.issueTokens(ctx, mustUser(t, srvc, t0.AccessToken).UID)
+			require.NoError(t, err)
+
+			t1, err := srvc.Refresh(ctx, t0.RefreshToken)
+			require.NoError(t, err)
+			assert.NotEqual(t, t0.RefreshToken, t1.RefreshToken)
+			_, _, err = srvc.GetUserByToken(ctx, t1.AccessToken)
+			require.NoError(t, err)
+
+			// the rotated out token shows up again: it was stolen, the whole session goes
+			_, err = srvc.Refresh(ctx, t0.RefreshToken)
+			assert.ErrorIs(t, err, models.ErrTokenRevoked)
+
+			_, err = srvc.Refresh(ctx, t1.RefreshToken)
+			assert.Error(t, err, "the current refresh token of the session is dead too")
+			_, _, err = srvc.GetUserByToken(ctx, t1.AccessToken)
+			assert.ErrorIs(t, err, models.ErrTokenRevoked)
+			_, _, err = srvc.GetUserByToken(ctx, t0.AccessToken)
+			assert.ErrorIs(t, err, models.ErrTokenRevoked, "access tokens issued before rotation are dead")
+
+			// other replicas learn it from the storage
+			_, _, err = testServiceKeys(t, storage, srvc).GetUserByToken(ctx, t1.AccessToken)
+			assert.ErrorIs(t, err, models.ErrTokenRevoked)
+
+			// other sessions of the user are untouched
+			_, _, err = srvc.GetUserByToken(ctx, other.AccessToken)
+			assert.NoError(t, err)
+			_, err = srvc.Refresh(ctx, other.RefreshToken)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRefreshInvalid(t *testing.T) {
+	storage := testStorages(t)["memory"]
+	srvc := testService(t, storage)
+	ctx := testContext(t)
+
+	_, err := srvc.Refresh(ctx, "")
+	assert.ErrorIs(t, err, models.ErrTokenInvalid)
+	_, err = srvc.Refresh(ctx, "never-issued")
+	assert.ErrorIs(t, err, models.ErrTokenInvalid)
+
+	srvc.refreshTTL = -time.Second
+	tokens, err := srvc.Register(ctx, "expired-"+testOrderNumber(), "Secret123")
+	require.NoError(t, err)
+	_, err = srvc.Refresh(ctx, tokens.RefreshToken)
+	assert.ErrorIs(t, err, models.ErrTokenInvalid, "expired refresh token")
+}
+
+func TestLogout(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			ctx := testContext(t)
+
+			tokens, err := srvc.Register(ctx, "logout-"+testOrderNumber(), "Secret123")
+			require.NoError(t, err)
+			user, sid, err := srvc.GetUserByToken(ctx, tokens.AccessToken)
+			require.NoError(t, err)
+
+			require.NoError(t, srvc.Logout(ctx, user, sid))
+			_, _, err = srvc.GetUserByToken(ctx, tokens.AccessToken)
+			assert.ErrorIs(t, err, models.ErrTokenRevoked)
+			_, err = srvc.Refresh(ctx, tokens.RefreshToken)
+			assert.ErrorIs(t, err, models.ErrTokenInvalid)
+		})
+	}
+}
+
+func TestRevocationCache(t *testing.T) {
+	c := newRevocationCache()
+	sid := uuid.New()
+
+	_, ok := c.get(sid)
+	assert.False(t, ok, "unknown session")
+
+	c.set(sid, false)
+	revoked, ok := c.get(sid)
+	assert.True(t, ok)
+	assert.False(t, revoked)
+
+	c.set(sid, true)
+	revoked, ok = c.get(sid)
+	assert.True(t, ok)
+	assert.True(t, revoked)
+
+	// stale entries are asked again
+	c.entries[sid] = revocationEntry{revoked: true, checkedAt: time.Now().Add(-revocationCacheTTL - time.Second)}
+	_, ok = c.get(sid)
+	assert.False(t, ok)
+
+	// a full cache drops stale entries first
+	for i := 0; i < revocationCacheSize; i++ {
+		c.entries[uuid.New()] = revocationEntry{checkedAt: time.Now().Add(-time.Hour)}
+	}
+	fresh := uuid.New()
+	c.set(fresh, true)
+	assert.Len(t, c.entries, 1)
+	_, ok = c.get(fresh)
+	assert.True(t, ok)
+}
+
+// mustUser returns the user of the access token
+func mustUser(t *testing.T, srvc *Service, access string) models.User {
+	t.Helper()
+	user, _, err := srvc.GetUserByToken(testContext(t), access)
+	require.NoError(t, err)
+	return user
+}
+
+// testServiceKeys makes another replica over the same storage and keys, with its own revocation cache
+func testServiceKeys(t *testing.T, storage Storage, srvc *Service) *Service {
+	t.Helper()
+	replica := testService(t, storage)
+	replica.keys = srvc.keys
+	return replica
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestStats(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			ctx := testContext(t)
+
+			// the database may be shared, so only the changes are checked
+			before, err := srvc.Stats(ctx)
+			require.NoError(t, err)
+
+			user := testUser(t, storage)
+			testCredit(t, storage, user, 100000)
+			for _, amount := range []models.Money{72998, 1050} {
+				order := models.Order{ID: testOrderNumber(), UID: user.UID, Amount: amount, UploadedAt: time.Now()}
+				require.NoError(t, storage.SaveWithdraw(ctx, user, order))
+			}
+
+			after, err := srvc.Stats(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 2, after.Withdrawals-before.Withdrawals)
+			assert.Equal(t, models.Money(74048), after.Withdrawn-before.Withdrawn)
+			assert.Equal(t, 1, after.Orders[models.AccrualStatusProcessed]-before.Orders[models.AccrualStatusProcessed])
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	postgres "github.com/stsg/gophermart/cmd/gophermart/store"
+	"github.com/stsg/gophermart/cmd/gophermart/store/memory"
+)
+
+// testDBEnv names the env var with a PostgreSQL URI the storage tests may write to
+const testDBEnv = "GOPHERMART_TEST_DATABASE_URI"
+
+// testMigrationVersion is the schema version the tests run against, same as in main
+const testMigrationVersion = 16
+
+var testSeq atomic.Int64
+
+// testStorages returns the storages to run a test against:
+// memory always, PostgreSQL if testDBEnv is set
+func testStorages(t *testing.T) map[string]Storage {
+	t.Helper()
+
+	storages := map[string]Storage{"memory": memory.New()}
+
+	uri := os.Getenv(testDBEnv)
+	if uri == "" {
+		t.Logf("%s is not set, PostgreSQL storage is not tested", testDBEnv)
+		return storages
+	}
+	pg, err := postgres.New(&postgres.Config{
+		ConnectionString: uri,
+		ConnectTimeout:   5 * time.Second,
+		QueryTimeout:     5 * time.Second,
+		MigrationVersion: testMigrationVersion,
+	})
+	require.NoError(t, err)
+	t.Cleanup(pg.Close)
+	storages["postgres"] = pg
+	return storages
+}
+
+// testUser creates a user with a login unique across test runs
+func testUser(t *testing.T, storage Storage) models.User {
+	t.Helper()
+
+	user := models.User{
+		UID:   uuid.New(),
+		Login: fmt.Sprintf("test-%d-%d", time.Now().UnixNano(), testSeq.Add(1)),
+		PHash: "-",
+		Role:  models.RoleUser,
+	}
+	_, err := storage.CreateUser(testContext(t), &user)
+	require.NoError(t, err)
+	return user
+}
+
+// testOrderNumber returns an order number unique across test runs
+func testOrderNumber() string {
+	return fmt.Sprintf("%d%04d", time.Now().UnixNano(), testSeq.Add(1)%10000)
+}
+
+// testCredit gives the user amount points through a processed order
+func testCredit(t *testing.T, storage Storage, user models.User, amount models.Money) {
+	t.Helper()
+
+	ctx := testContext(t)
+	order, err := storage.SaveOrder(ctx, user, models.Order{
+		ID:            testOrderNumber(),
+		UID:           user.UID,
+		AccrualStatus: models.AccrualStatusNew,
+		UploadedAt:    time.Now(),
+	})
+	require.NoError(t, err)
+	_, err = storage.UpdateOrderStatus(ctx, order.ID, models.AccrualStatusProcessed, amount)
+	require.NoError(t, err)
+}
+
+// testContext returns a context that is cancelled when the test ends or takes too long
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// testPolicy is the default policy of the command line flags
+var testPolicy = Policy{LoginMinLen: 3, LoginMaxLen: 64, PasswordMinLen: 8, PasswordClasses: 2}
+
+// testService returns a service on storage with a random JWT secret and the cheapest bcrypt
+func testService(t *testing.T, storage Storage) *Service {
+	t.Helper()
+
+	keys := lib.NewKeySet()
+	require.NoError(t, keys.AddSecret("test", []byte(uuid.NewString())))
+	require.NoError(t, keys.SetSigningKey("test"))
+
+	return New(storage, &Config{
+		Keys:       keys,
+		AccessTTL:  time.Minute,
+		RefreshTTL: time.Hour,
+		Policy:     testPolicy,
+		BcryptCost: bcrypt.MinCost,
+		ResetTTL:   time.Minute,
+	})
+}
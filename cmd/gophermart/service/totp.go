@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+const (
+	totpIssuer        = "gophermart"
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// EnrollTOTP starts 2FA enrolment with a new secret, it is enabled by VerifyTOTP
+func (s *Service) EnrollTOTP(ctx context.Context, user models.User) (models.TOTPEnrollResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.EnrollTOTP")
+	defer span.End()
+
+	secret, err := lib.NewTOTPSecret()
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create totp secret", "err", err)
+		return models.TOTPEnrollResponse{}, err
+	}
+
+	sealed, err := s.totpBox.Seal(secret, user.UID.String())
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot encrypt totp secret", "err", err)
+		return models.TOTPEnrollResponse{}, err
+	}
+	err = s.storage.SaveTOTPSecret(ctx, user.UID, sealed)
+	if err != nil {
+		return models.TOTPEnrollResponse{}, err
+	}
+
+	return models.TOTPEnrollResponse{
+		Secret: secret,
+		URI:    lib.TOTPURI(totpIssuer, user.Login, secret),
+	}, nil
+}
+
+// VerifyTOTP enables 2FA once the user proves the authenticator works and
+// returns the recovery codes, they are shown this time only
+func (s *Service) VerifyTOTP(ctx context.Context, user models.User, code string) (models.TOTPVerifyResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.VerifyTOTP")
+	defer span.End()
+
+	totp, err := s.getTOTP(ctx, user.UID)
+	if err != nil {
+		return models.TOTPVerifyResponse{}, err
+	}
+	if totp.Enabled {
+		return models.TOTPVerifyResponse{}, models.ErrTOTPEnabled
+	}
+	if totp.Secret == "" {
+		return models.TOTPVerifyResponse{}, models.ErrTOTPNotEnrolled
+	}
+
+	step, ok := lib.ValidateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return models.TOTPVerifyResponse{}, models.ErrTOTPCodeInvalid
+	}
+
+	codes, err := lib.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create recovery codes", "err", err)
+		return models.TOTPVerifyResponse{}, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, c := range codes {
+		hashes = append(hashes, lib.HashToken(c))
+	}
+
+	err = s.storage.EnableTOTP(ctx, user.UID, step, hashes)
+	if err != nil {
+		return models.TOTPVerifyResponse{}, err
+	}
+	slog.InfoContext(ctx, "2FA enabled", "login", user.Login)
+
+	return models.TOTPVerifyResponse{RecoveryCodes: codes}, nil
+}
+
+// CompleteMFALogin exchanges the partial token of Login and a TOTP or recovery code
+// for a token pair, wrong codes count as failed logins
+func (s *Service) CompleteMFALogin(ctx context.Context, mfaToken, code, ip string) (models.TokenResponse, error) {
+	ctx, span := tracing.Start(ctx, "Service.CompleteMFALogin")
+	defer span.End()
+
+	claims, err := lib.CheckJWT(s.keys, mfaToken)
+	if err != nil || !claims.MFA {
+		slog.ErrorContext(ctx, "invalid MFA token", "err", err)
+		return models.TokenResponse{}, models.ErrTokenInvalid
+	}
+
+	user, err := s.storage.GetUserByUUID(ctx, claims.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "user not found", "uid", claims.UserID, "err", err)
+		return models.TokenResponse{}, models.ErrUserNotFound
+	}
+
+	keys := loginKeys(NormalizeLogin(user.Login), ip)
+	err = s.checkLockout(ctx, keys)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+
+	err = s.checkSecondFactor(ctx, user, code)
+	if err != nil {
+		if !errors.Is(err, models.ErrTOTPCodeInvalid) {
+			return models.TokenResponse{}, err
+		}
+		slog.WarnContext(ctx, "wrong 2FA code", "login", user.Login)
+		s.audit(ctx, models.AuditEntry{
+			Action:    models.AuditLoginFailure,
+			TargetUID: user.UID,
+			Details:   models.AuditValues(map[string]interface{}{"reason": "wrong 2FA code"}),
+		})
+		if lerr := s.loginFailed(ctx, keys); lerr != nil {
+			return models.TokenResponse{}, lerr
+		}
+		return models.TokenResponse{}, err
+	}
+
+	tokens, err := s.issueTokens(ctx, user.UID)
+	if err != nil {
+		return tokens, err
+	}
+	s.audit(ctx, models.AuditEntry{
+		Action:    models.AuditLoginSuccess,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		Details:   models.AuditValues(map[string]interface{}{"mfa": true}),
+	})
+	return tokens, nil
+}
+
+func (s *Service) checkSecondFactor(ctx context.Context, user models.User, code string) error {
+	totp, err := s.getTOTP(ctx, user.UID)
+	if err != nil {
+		return err
+	}
+	if !totp.Enabled {
+		return models.ErrTOTPNotEnrolled
+	}
+
+	if step, ok := lib.ValidateTOTP(totp.Secret, code, time.Now()); ok {
+		return s.storage.UseTOTPStep(ctx, user.UID, step)
+	}
+
+	err = s.storage.UseRecoveryCode(ctx, user.UID, lib.HashToken(lib.NormalizeRecoveryCode(code)))
+	if err == nil {
+		slog.InfoContext(ctx, "logged in with a recovery code", "login", user.Login)
+	}
+	return err
+}
+
+// getTOTP returns the second factor of the user with the secret decrypted
+func (s *Service) getTOTP(ctx context.Context, uid uuid.UUID) (models.TOTP, error) {
+	totp, err := s.storage.GetTOTP(ctx, uid)
+	if err != nil || totp.Secret == "" {
+		return totp, err
+	}
+	totp.Secret, err = s.totpBox.Open(totp.Secret, uid.String())
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot decrypt totp secret", "uid", uid, "err", err)
+		return totp, err
+	}
+	return totp, nil
+}
+
+// SealTOTPSecrets encrypts the TOTP secrets stored before the key was set. It
+// runs on startup, sealed secrets are left alone, so it does anything only once.
+func (s *Service) SealTOTPSecrets(ctx context.Context) (int, error) {
+	if s.totpBox == nil {
+		return 0, nil
+	}
+
+	secrets, err := s.storage.ListTOTPSecrets(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sealed := 0
+	for _, totp := range secrets {
+		if lib.IsSealed(totp.Secret) {
+			continue
+		}
+		value, err := s.totpBox.Seal(totp.Secret, totp.UID.String())
+		if err != nil {
+			return sealed, err
+		}
+		err = s.storage.ReplaceTOTPSecret(ctx, totp.UID, totp.Secret, value)
+		if err != nil {
+			return sealed, err
+		}
+		sealed++
+	}
+	return sealed, nil
+}
+
+// mfaChallenge returns the partial token if the user has 2FA enabled, nil otherwise
+func (s *Service) mfaChallenge(ctx context.Context, user models.User) (*models.MFAResponse, error) {
+	totp, err := s.storage.GetTOTP(ctx, user.UID)
+	if err != nil || !totp.Enabled {
+		return nil, err
+	}
+
+	token, err := lib.CreateMFAJWT(s.keys, user.UID, mfaTokenTTL)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create MFA JWT", "err", err)
+		return nil, err
+	}
+	return &models.MFAResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(mfaTokenTTL.Seconds()),
+	}, nil
+}
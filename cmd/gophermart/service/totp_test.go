@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/lib"
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestTOTPLogin(t *testing.T) {
+	storage := testStorages(t)["memory"]
+	srvc := testService(t, storage)
+	box, err := lib.NewSecretBox(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	srvc.totpBox = box
+	ctx := testContext(t)
+
+	_, err = srvc.Register(ctx, "alice", "Secret123")
+	require.NoError(t, err)
+	user, err := storage.GetUserByLogin(ctx, "alice")
+	require.NoError(t, err)
+
+	enroll, err := srvc.EnrollTOTP(ctx, user)
+	require.NoError(t, err)
+
+	stored, err := storage.GetTOTP(ctx, user.UID)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Secret, "v1:"), "secret is encrypted at rest")
+	assert.NotContains(t, stored.Secret, enroll.Secret)
+
+	code := func(step int64) string {
+		c, err := lib.TOTPCode(enroll.Secret, step)
+		require.NoError(t, err)
+		return c
+	}
+	now := lib.TOTPStep(time.Now())
+
+	_, err = srvc.VerifyTOTP(ctx, user, "000000")
+	assert.ErrorIs(t, err, models.ErrTOTPCodeInvalid)
+	verify, err := srvc.VerifyTOTP(ctx, user, code(now))
+	require.NoError(t, err)
+	require.Len(t, verify.RecoveryCodes, recoveryCodeCount)
+
+	login := func() string {
+		tokens, mfa, err := srvc.Login(ctx, "alice", "Secret123", "")
+		require.NoError(t, err)
+		require.NotNil(t, mfa, "second factor is required")
+		assert.Empty(t, tokens.AccessToken)
+		return mfa.MFAToken
+	}
+
+	// the step used to enable 2FA cannot log in again
+	_, err = srvc.CompleteMFALogin(ctx, login(), code(now), "")
+	assert.ErrorIs(t, err, models.ErrTOTPCodeInvalid, "replayed step")
+
+	tokens, err := srvc.CompleteMFALogin(ctx, login(), code(now+1), "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+
+	_, err = srvc.CompleteMFALogin(ctx, login(), code(now+1), "")
+	assert.ErrorIs(t, err, models.ErrTOTPCodeInvalid, "replayed code")
+	_, err = srvc.CompleteMFALogin(ctx, login(), code(now), "")
+	assert.ErrorIs(t, err, models.ErrTOTPCodeInvalid, "older step")
+
+	// recovery codes work once each, typed loosely
+	recovery := verify.RecoveryCodes[0]
+	tokens, err = srvc.CompleteMFALogin(ctx, login(), " "+strings.ToUpper(recovery)+" ", "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+
+	_, err = srvc.CompleteMFALogin(ctx, login(), recovery, "")
+	assert.ErrorIs(t, err, models.ErrTOTPCodeInvalid, "used recovery code")
+
+	_, err = srvc.CompleteMFALogin(ctx, login(), verify.RecoveryCodes[1], "")
+	assert.NoError(t, err, "other recovery codes still work")
+
+	_, err = srvc.EnrollTOTP(ctx, user)
+	assert.ErrorIs(t, err, models.ErrTOTPEnabled, "enabled secret is not replaced")
+}
+
+func TestSealTOTPSecrets(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			srvc := testService(t, storage)
+			ctx := testContext(t)
+
+			// a second factor enabled while secrets were kept as is
+			plain := testUser(t, storage)
+			secret, err := lib.NewTOTPSecret()
+			require.NoError(t, err)
+			require.NoError(t, storage.SaveTOTPSecret(ctx, plain.UID, secret))
+			require.NoError(t, storage.EnableTOTP(ctx, plain.UID, 1, nil))
+
+			box, err := lib.NewSecretBox(bytes.Repeat([]byte{2}, 32))
+			require.NoError(t, err)
+			srvc.totpBox = box
+
+			// with the key set the plain secret is refused until it is sealed
+			code, err := lib.TOTPCode(secret, lib.TOTPStep(time.Now()))
+			require.NoError(t, err)
+			assert.Error(t, srvc.checkSecondFactor(ctx, plain, code))
+
+			n, err := srvc.SealTOTPSecrets(ctx)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, n, 1)
+			stored, err := storage.GetTOTP(ctx, plain.UID)
+			require.NoError(t, err)
+			assert.True(t, lib.IsSealed(stored.Secret))
+			assert.NoError(t, srvc.checkSecondFactor(ctx, plain, code), "sealed secret works")
+
+			n, err = srvc.SealTOTPSecrets(ctx)
+			require.NoError(t, err)
+			assert.Zero(t, n, "sealed secrets are left alone")
+
+			// a secret planted in the database afterwards is refused
+			planted := testUser(t, storage)
+			require.NoError(t, storage.SaveTOTPSecret(ctx, planted.UID, secret))
+			require.NoError(t, storage.EnableTOTP(ctx, planted.UID, 1, nil))
+			assert.Error(t, srvc.checkSecondFactor(ctx, planted, code))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+const (
+	anonymizeInterval = time.Hour
+	exportPageSize    = 100
+)
+
+// DeleteUser soft deletes the account after checking the password, login stops
+// working at once and the login is anonymized after the retention period
+func (s *Service) DeleteUser(ctx context.Context, user models.User, password string) error {
+	ctx, span := tracing.Start(ctx, "Service.DeleteUser")
+	defer span.End()
+
+	err := comparePassword(ctx, user, password)
+	if err != nil {
+		slog.ErrorContext(ctx, "wrong password", "login", user.Login, "err", err)
+		return models.ErrUserWrongPassword
+	}
+
+	sids, err := s.storage.DeleteUser(ctx, user.UID)
+	if err != nil {
+		return err
+	}
+	s.audit(ctx, models.AuditEntry{Action: models.AuditUserDelete, ActorUID: user.UID, TargetUID: user.UID})
+	s.revokeAll(ctx, user.UID, sids, "account deletion")
+	slog.InfoContext(ctx, "user deleted, sessions revoked", "login", user.Login, "sessions", len(sids))
+	return nil
+}
+
+// ExportUser collects everything kept about the user
+func (s *Service) ExportUser(ctx context.Context, user models.User) (models.UserExport, error) {
+	ctx, span := tracing.Start(ctx, "Service.ExportUser")
+	defer span.End()
+
+	export := models.UserExport{
+		Profile:        models.UserProfile{UID: user.UID, Login: user.Login},
+		Orders:         []models.OrderResponse{},
+		Withdrawals:    []models.WithdrawalsResponse{},
+		BalanceHistory: []models.LedgerEntryResponse{},
+		ExportedAt:     time.Now(),
+	}
+
+	totp, err := s.storage.GetTOTP(ctx, user.UID)
+	if err != nil {
+		return export, err
+	}
+	export.Profile.TwoFactor = totp.Enabled
+
+	export.Balance, err = s.storage.GetBalance(ctx, user.UID)
+	if err != nil {
+		return export, err
+	}
+	orders, err := s.storage.GetOrders(ctx, user.UID)
+	if err != nil {
+		return export, err
+	}
+	export.Orders = append(export.Orders, orders...)
+	withdrawals, err := s.storage.GetWithdrawals(ctx, user.UID)
+	if err != nil {
+		return export, err
+	}
+	export.Withdrawals = append(export.Withdrawals, withdrawals...)
+
+	for offset := 0; ; offset += exportPageSize {
+		entries, err := s.storage.GetLedger(ctx, user.UID, exportPageSize, offset)
+		if err != nil {
+			return export, err
+		}
+		export.BalanceHistory = append(export.BalanceHistory, entries...)
+		if len(entries) < exportPageSize {
+			break
+		}
+	}
+
+	return export, nil
+}
+
+// AnonymizeDeleted anonymizes accounts deleted longer than the retention period ago,
+// it runs until ctx is done
+func (s *Service) AnonymizeDeleted(ctx context.Context) {
+	slog.InfoContext(ctx, "AnonymizeDeleted", "retention", s.retention)
+	for {
+		n, err := s.storage.AnonymizeUsers(ctx, time.Now().Add(-s.retention))
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot anonymize deleted users", "err", err)
+		}
+		if n > 0 {
+			slog.InfoContext(ctx, "deleted users anonymized", "count", n)
+		}
+		if !sleep(ctx, anonymizeInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func TestSaveWithdrawConcurrent(t *testing.T) {
+	const (
+		workers = 50
+		balance = models.Money(100000) // 1000 points
+		amount  = models.Money(3000)   // 30 points
+		fit     = int(balance / amount)
+	)
+
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := testContext(t)
+			user := testUser(t, storage)
+			testCredit(t, storage, user, balance)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var ok, declined int
+			var failed []error
+
+			start := make(chan struct{})
+			for i := 0; i < workers; i++ {
+				order := models.Order{ID: testOrderNumber(), UID: user.UID, Amount: amount, UploadedAt: time.Now()}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					err := storage.SaveWithdraw(ctx, user, order)
+
+					mu.Lock()
+					defer mu.Unlock()
+					switch {
+					case err == nil:
+						ok++
+					case errors.Is(err, models.ErrBalanceWrong):
+						declined++
+					default:
+						failed = append(failed, err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			require.Empty(t, failed)
+			assert.Equal(t, fit, ok, "withdrawals that fit the balance")
+			assert.Equal(t, workers-fit, declined, "withdrawals declined")
+
+			bal, err := storage.GetBalance(ctx, user.UID)
+			require.NoError(t, err)
+			assert.Equal(t, balance-models.Money(fit)*amount, bal.Current)
+			assert.Equal(t, models.Money(fit)*amount, bal.Withdrawn)
+			assert.GreaterOrEqual(t, bal.Current, models.Money(0))
+
+			withdrawals, err := storage.GetWithdrawals(ctx, user.UID)
+			require.NoError(t, err)
+			assert.Len(t, withdrawals, fit)
+		})
+	}
+}
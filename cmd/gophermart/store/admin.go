@@ -0,0 +1,198 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+// SearchUsers finds users by a login substring or the exact uid, deleted ones included
+func (p *Storage) SearchUsers(ctx context.Context, query string, limit, offset int) ([]models.UserSummary, error) {
+	users := []models.UserSummary{}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	rows, err := p.db.Query(
+		ctx,
+		"SELECT uid, login, role, deleted FROM users WHERE login ILIKE $1 OR uid::text = $2 ORDER BY login LIMIT $3 OFFSET $4",
+		pattern, query, limit, offset,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot search users", "err", err)
+		return users, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user := models.UserSummary{}
+		err := rows.Scan(&user.UID, &user.Login, &user.Role, &user.Deleted)
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot scan", "err", err)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (p *Storage) SetUserRole(ctx context.Context, uid uuid.UUID, role models.Role, audit models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var previous models.Role
+	err = tx.QueryRow(ctx, "SELECT role FROM users WHERE uid=$1 AND NOT deleted FOR UPDATE", uid).Scan(&previous)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ErrUserNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get user role", "uid", uid, "err", err)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE users SET role=$2 WHERE uid=$1", uid, role)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot set user role", "uid", uid, "err", err)
+		return err
+	}
+
+	audit.Before = models.AuditValues(map[string]interface{}{"role": previous})
+	audit.After = models.AuditValues(map[string]interface{}{"role": role})
+
+	err = appendAudit(ctx, tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// CountUsersByRole counts the users of the role, deleted ones excluded
+func (p *Storage) CountUsersByRole(ctx context.Context, role models.Role) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	var n int
+	err := p.db.QueryRow(ctx, "SELECT count(*) FROM users WHERE role=$1 AND NOT deleted", role).Scan(&n)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot count users by role", "role", role, "err", err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// RequeueAccrualJob schedules a stuck order for an immediate accrual round,
+// orders in a final status get ErrOrderStatusTransition
+func (p *Storage) RequeueAccrualJob(ctx context.Context, orderID string, audit models.AuditEntry) error {
+	var uid uuid.UUID
+	var status models.AccrualStatus
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, "SELECT uid, status FROM orders WHERE id=$1 AND NOT deleted FOR UPDATE", orderID).Scan(&uid, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ErrOrderNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get order", "order", orderID, "err", err)
+		return err
+	}
+	if status.IsFinal() {
+		return models.ErrOrderStatusTransition
+	}
+
+	stage := models.AccrualJobPoll
+	if status == models.AccrualStatusNew {
+		stage = models.AccrualJobRegister
+	}
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO accrual_jobs (order_id, uid, stage, trace_parent) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (order_id) DO UPDATE
+		SET stage=EXCLUDED.stage, attempts=0, next_attempt_at=now(), last_error=NULL, trace_parent=EXCLUDED.trace_parent`,
+		orderID, uid, stage, nullString(tracing.TraceParent(ctx)),
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot requeue accrual job", "order", orderID, "err", err)
+		return err
+	}
+
+	audit.TargetUID = uid
+	err = appendAudit(ctx, tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// AdjustBalance applies a manual correction to the balance, the ledger and the
+// audit trail in one tx. A correction driving the balance negative gets ErrBalanceWrong.
+func (p *Storage) AdjustBalance(ctx context.Context, adj models.Adjustment, audit models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var current models.Money
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO balances (uid, current_balance) VALUES ($1, $2)
+		ON CONFLICT (uid) DO UPDATE SET current_balance = balances.current_balance + EXCLUDED.current_balance
+		RETURNING current_balance`,
+		adj.UID, adj.Amount,
+	).Scan(&current)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.CheckViolation {
+			return models.ErrBalanceWrong
+		}
+		slog.ErrorContext(ctx, "cannot adjust balance", "uid", adj.UID, "err", err)
+		return err
+	}
+
+	err = appendLedger(ctx, tx, models.LedgerEntry{
+		UID:     adj.UID,
+		OrderID: adj.ID,
+		Amount:  adj.Amount,
+		Reason:  models.LedgerReasonAdjustment,
+	})
+	if err != nil {
+		return err
+	}
+
+	audit.Before = models.AuditValues(map[string]interface{}{"current": current - adj.Amount})
+	audit.After = models.AuditValues(map[string]interface{}{"current": current})
+	err = appendAudit(ctx, tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
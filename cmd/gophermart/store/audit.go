@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// appendAudit records an audit entry inside the caller's tx,
+// request details missing in the entry are taken from the context
+func appendAudit(ctx context.Context, tx pgx.Tx, entry models.AuditEntry) error {
+	meta := models.AuditMetaFrom(ctx)
+	if entry.IP == "" {
+		entry.IP = meta.IP
+	}
+	if entry.RequestID == "" {
+		entry.RequestID = meta.RequestID
+	}
+
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO audit_log (action, actor_uid, target_uid, order_id, ip, request_id, details, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		entry.Action,
+		nullUUID(entry.ActorUID),
+		nullUUID(entry.TargetUID),
+		nullString(entry.OrderID),
+		nullString(entry.IP),
+		nullString(entry.RequestID),
+		nullJSON(entry.Details),
+		nullJSON(entry.Before),
+		nullJSON(entry.After),
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot append audit entry", "action", entry.Action, "err", err)
+		return err
+	}
+	return nil
+}
+
+// AppendAudit records an audit entry of an action done outside of storage transactions
+func (p *Storage) AppendAudit(ctx context.Context, entry models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = appendAudit(ctx, tx, entry)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetAudit returns the audit entries matching the query, newest first
+func (p *Storage) GetAudit(ctx context.Context, query models.AuditQuery) ([]models.AuditEntry, error) {
+	entries := []models.AuditEntry{}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+	filter := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if query.Action != "" {
+		filter("action=$%d", query.Action)
+	}
+	if query.ActorUID != uuid.Nil {
+		filter("actor_uid=$%d", query.ActorUID)
+	}
+	if query.TargetUID != uuid.Nil {
+		filter("target_uid=$%d", query.TargetUID)
+	}
+	if query.OrderID != "" {
+		filter("order_id=$%d", query.OrderID)
+	}
+	if !query.Since.IsZero() {
+		filter("created_at>=$%d", query.Since)
+	}
+	if !query.Until.IsZero() {
+		filter("created_at<$%d", query.Until)
+	}
+
+	sql := `SELECT id, action, actor_uid, target_uid, COALESCE(order_id, ''), COALESCE(ip, ''),
+		COALESCE(request_id, ''), details, before, after, created_at FROM audit_log`
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, query.Limit, query.Offset)
+	sql += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := p.db.Query(ctx, sql, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get audit log", "err", err)
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry models.AuditEntry
+		var actor, target *uuid.UUID
+		var details, before, after []byte
+		err := rows.Scan(&entry.ID, &entry.Action, &actor, &target, &entry.OrderID, &entry.IP,
+			&entry.RequestID, &details, &before, &after, &entry.CreatedAt)
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot scan", "err", err)
+			continue
+		}
+		if actor != nil {
+			entry.ActorUID = *actor
+		}
+		if target != nil {
+			entry.TargetUID = *target
+		}
+		entry.Details, entry.Before, entry.After = details, before, after
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func nullUUID(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+	return &id
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func nullJSON(data json.RawMessage) *string {
+	if len(data) == 0 {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// ClaimAccrualJob takes a due job of the stage and hides it from other workers
+// for the lease duration. Rows locked by another replica are skipped, a job whose
+// worker died becomes due again once the lease expires. Users served least recently
+// go first, so a flood of orders from one user does not starve the others.
+func (p *Storage) ClaimAccrualJob(ctx context.Context, stage models.AccrualJobStage, lease time.Duration) (models.AccrualJob, error) {
+	var job models.AccrualJob
+	var lastError, traceParent *string
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(
+		ctx,
+		`UPDATE accrual_jobs SET attempts=attempts+1, claimed_at=now(), next_attempt_at=now()+make_interval(secs => $2)
+		WHERE order_id = (
+			SELECT j.order_id FROM accrual_jobs j
+			WHERE j.stage=$1 AND j.next_attempt_at <= now()
+			ORDER BY (SELECT max(u.claimed_at) FROM accrual_jobs u WHERE u.uid=j.uid) NULLS FIRST, j.next_attempt_at
+			LIMIT 1
+			FOR UPDATE OF j SKIP LOCKED
+		)
+		RETURNING order_id, uid, stage, next_attempt_at, attempts, last_error, trace_parent`,
+		stage, lease.Seconds(),
+	).Scan(&job.OrderID, &job.UID, &job.Stage, &job.NextAttemptAt, &job.Attempts, &lastError, &traceParent)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return job, models.ErrJobNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot claim accrual job", "err", err)
+		return job, err
+	}
+
+	if lastError != nil {
+		job.LastError = *lastError
+	}
+	if traceParent != nil {
+		job.TraceParent = *traceParent
+	}
+	return job, nil
+}
+
+// RescheduleAccrualJob moves the job to the stage and makes it due after delay,
+// the attempt counter restarts when the stage changes
+func (p *Storage) RescheduleAccrualJob(ctx context.Context, orderID string, stage models.AccrualJobStage, delay time.Duration, lastError string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(
+		ctx,
+		`UPDATE accrual_jobs SET
+			attempts=CASE WHEN stage=$2 THEN attempts ELSE 0 END,
+			stage=$2,
+			next_attempt_at=now()+make_interval(secs => $3),
+			last_error=NULLIF($4, '')
+		WHERE order_id=$1`,
+		orderID, stage, delay.Seconds(), lastError,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot reschedule accrual job", "order", orderID, "err", err)
+		return err
+	}
+	return nil
+}
+
+func (p *Storage) CompleteAccrualJob(ctx context.Context, orderID string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(ctx, "DELETE FROM accrual_jobs WHERE order_id=$1", orderID)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot complete accrual job", "order", orderID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// AccrualQueueDepth counts the orders still waiting for the accrual system
+func (p *Storage) AccrualQueueDepth(ctx context.Context) (int, error) {
+	var depth int
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(ctx, "SELECT count(*) FROM accrual_jobs").Scan(&depth)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot count accrual jobs", "err", err)
+		return 0, err
+	}
+	return depth, nil
+}
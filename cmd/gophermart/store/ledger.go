@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// appendLedger records a balance movement inside the caller's tx
+func appendLedger(ctx context.Context, tx pgx.Tx, entry models.LedgerEntry) error {
+	_, err := tx.Exec(
+		ctx,
+		"INSERT INTO ledger (uid, order_id, amount, reason) VALUES ($1, $2, $3, $4)",
+		entry.UID,
+		entry.OrderID,
+		entry.Amount,
+		entry.Reason,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot append ledger entry", "reason", entry.Reason, "order", entry.OrderID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// GetLedger returns a page of the user's balance movements, newest first
+func (p *Storage) GetLedger(ctx context.Context, uid uuid.UUID, limit, offset int) ([]models.LedgerEntryResponse, error) {
+	var entries []models.LedgerEntryResponse
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	rows, err := p.db.Query(
+		ctx,
+		"SELECT order_id, amount, reason, created_at FROM ledger WHERE uid=$1 ORDER BY id DESC LIMIT $2 OFFSET $3",
+		uid, limit, offset,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get ledger", "err", err)
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := models.LedgerEntryResponse{}
+		err := rows.Scan(&entry.Order, &entry.Amount, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot scan", "err", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
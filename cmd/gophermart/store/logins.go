@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// AddLoginFailure records a failed login for the key and returns the number
+// of failures within the sliding window, older ones are dropped on the way
+func (p *Storage) AddLoginFailure(ctx context.Context, key string, window time.Duration) (int, error) {
+	var failures int
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	since := time.Now().Add(-window)
+	_, err := p.db.Exec(ctx, "DELETE FROM login_failures WHERE failed_at < $1", since)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot drop old login failures", "err", err)
+		return 0, err
+	}
+
+	err = p.db.QueryRow(
+		ctx,
+		`WITH added AS (INSERT INTO login_failures (key) VALUES ($1) RETURNING 1)
+		SELECT (SELECT count(*) FROM login_failures WHERE key=$1 AND failed_at >= $2) + (SELECT count(*) FROM added)`,
+		key, since,
+	).Scan(&failures)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot add login failure", "key", key, "err", err)
+		return 0, err
+	}
+	return failures, nil
+}
+
+func (p *Storage) GetLoginLockout(ctx context.Context, key string) (models.LoginLockout, error) {
+	lockout := models.LoginLockout{Key: key}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(
+		ctx,
+		"SELECT level, locked_until FROM login_lockouts WHERE key=$1",
+		key,
+	).Scan(&lockout.Level, &lockout.LockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return lockout, nil
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get login lockout", "key", key, "err", err)
+		return lockout, err
+	}
+	return lockout, nil
+}
+
+// SetLoginLockout locks the key out and restarts its failure window
+func (p *Storage) SetLoginLockout(ctx context.Context, lockout models.LoginLockout) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO login_lockouts (key, level, locked_until) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET level=EXCLUDED.level, locked_until=EXCLUDED.locked_until`,
+		lockout.Key, lockout.Level, lockout.LockedUntil,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot set login lockout", "key", lockout.Key, "err", err)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM login_failures WHERE key=$1", lockout.Key)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot reset login failures", "key", lockout.Key, "err", err)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ResetLoginFailures forgets failures and lockouts of the key
+func (p *Storage) ResetLoginFailures(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(ctx, "DELETE FROM login_failures WHERE key=$1", key)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot reset login failures", "key", key, "err", err)
+		return err
+	}
+	_, err = p.db.Exec(ctx, "DELETE FROM login_lockouts WHERE key=$1", key)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot reset login lockout", "key", key, "err", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+func (m *Storage) SearchUsers(ctx context.Context, query string, limit, offset int) ([]models.UserSummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := []models.UserSummary{}
+	for login, user := range m.users {
+		if !strings.Contains(strings.ToLower(login), strings.ToLower(query)) && user.UID.String() != query {
+			continue
+		}
+		_, deleted := m.deleted[user.UID]
+		users = append(users, models.UserSummary{UID: user.UID, Login: login, Role: user.Role, Deleted: deleted})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Login < users[j].Login
+	})
+
+	if offset >= len(users) {
+		return []models.UserSummary{}, nil
+	}
+	users = users[offset:]
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *Storage) SetUserRole(ctx context.Context, uid uuid.UUID, role models.Role, audit models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.userLogin(uid)
+	if _, deleted := m.deleted[uid]; !ok || deleted {
+		return models.ErrUserNotFound
+	}
+	user := m.users[login]
+	audit.Before = models.AuditValues(map[string]interface{}{"role": user.Role})
+	audit.After = models.AuditValues(map[string]interface{}{"role": role})
+	user.Role = role
+	m.users[login] = user
+
+	m.appendAudit(ctx, audit)
+	return nil
+}
+
+func (m *Storage) CountUsersByRole(ctx context.Context, role models.Role) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := 0
+	for _, user := range m.users {
+		if _, deleted := m.deleted[user.UID]; !deleted && user.Role == role {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Storage) RequeueAccrualJob(ctx context.Context, orderID string, audit models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[orderID]
+	if !ok {
+		return models.ErrOrderNotFound
+	}
+	if order.AccrualStatus.IsFinal() {
+		return models.ErrOrderStatusTransition
+	}
+
+	stage := models.AccrualJobPoll
+	if order.AccrualStatus == models.AccrualStatusNew {
+		stage = models.AccrualJobRegister
+	}
+	m.jobs[orderID] = &models.AccrualJob{
+		OrderID:       orderID,
+		UID:           order.UID,
+		Stage:         stage,
+		NextAttemptAt: time.Now(),
+		TraceParent:   tracing.TraceParent(ctx),
+	}
+
+	audit.TargetUID = order.UID
+	m.appendAudit(ctx, audit)
+	return nil
+}
+
+func (m *Storage) AdjustBalance(ctx context.Context, adj models.Adjustment, audit models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bal, ok := m.balances[adj.UID]
+	if !ok {
+		bal = &balance{}
+	}
+	if bal.current+adj.Amount < 0 {
+		return models.ErrBalanceWrong
+	}
+	m.balances[adj.UID] = bal
+	audit.Before = models.AuditValues(map[string]interface{}{"current": bal.current})
+	bal.current += adj.Amount
+	audit.After = models.AuditValues(map[string]interface{}{"current": bal.current})
+	m.appendLedger(models.LedgerEntry{
+		UID:     adj.UID,
+		OrderID: adj.ID,
+		Amount:  adj.Amount,
+		Reason:  models.LedgerReasonAdjustment,
+	})
+
+	m.appendAudit(ctx, audit)
+	return nil
+}
@@ -0,0 +1,50 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// appendAudit records an audit entry, caller must hold the lock
+func (m *Storage) appendAudit(ctx context.Context, entry models.AuditEntry) {
+	meta := models.AuditMetaFrom(ctx)
+	if entry.IP == "" {
+		entry.IP = meta.IP
+	}
+	if entry.RequestID == "" {
+		entry.RequestID = meta.RequestID
+	}
+	entry.ID = int64(len(m.audit) + 1)
+	entry.CreatedAt = time.Now()
+	m.audit = append(m.audit, entry)
+}
+
+func (m *Storage) AppendAudit(ctx context.Context, entry models.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.appendAudit(ctx, entry)
+	return nil
+}
+
+// GetAudit returns the audit entries matching the query, newest first
+func (m *Storage) GetAudit(ctx context.Context, query models.AuditQuery) ([]models.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := []models.AuditEntry{}
+	skipped := 0
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < query.Limit; i-- {
+		if !query.Match(m.audit[i]) {
+			continue
+		}
+		if skipped < query.Offset {
+			skipped++
+			continue
+		}
+		entries = append(entries, m.audit[i])
+	}
+	return entries, nil
+}
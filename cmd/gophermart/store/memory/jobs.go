@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) ClaimAccrualJob(ctx context.Context, stage models.AccrualJobStage, lease time.Duration) (models.AccrualJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due *models.AccrualJob
+	for _, job := range m.jobs {
+		if job.Stage != stage || job.NextAttemptAt.After(now) {
+			continue
+		}
+		if due == nil || m.claimsBefore(job, due) {
+			due = job
+		}
+	}
+	if due == nil {
+		return models.AccrualJob{}, models.ErrJobNotFound
+	}
+
+	m.served[due.UID] = now
+	due.Attempts++
+	due.NextAttemptAt = now.Add(lease)
+	return *due, nil
+}
+
+func (m *Storage) RescheduleAccrualJob(ctx context.Context, orderID string, stage models.AccrualJobStage, delay time.Duration, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[orderID]
+	if !ok {
+		return models.ErrJobNotFound
+	}
+
+	if job.Stage != stage {
+		job.Attempts = 0
+	}
+	job.Stage = stage
+	job.NextAttemptAt = time.Now().Add(delay)
+	job.LastError = lastError
+	return nil
+}
+
+func (m *Storage) CompleteAccrualJob(ctx context.Context, orderID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.jobs, orderID)
+	return nil
+}
+
+func (m *Storage) AccrualQueueDepth(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.jobs), nil
+}
+
+// claimsBefore tells whether job a goes ahead of job b: the user served least
+// recently first, then the job due earliest
+func (m *Storage) claimsBefore(a, b *models.AccrualJob) bool {
+	servedA, servedB := m.served[a.UID], m.served[b.UID]
+	if !servedA.Equal(servedB) {
+		return servedA.Before(servedB)
+	}
+	return a.NextAttemptAt.Before(b.NextAttemptAt)
+}
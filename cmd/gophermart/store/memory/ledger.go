@@ -0,0 +1,42 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// appendLedger records a balance movement, caller must hold the lock
+func (m *Storage) appendLedger(entry models.LedgerEntry) {
+	entry.ID = int64(len(m.ledger) + 1)
+	entry.CreatedAt = time.Now()
+	m.ledger = append(m.ledger, entry)
+}
+
+func (m *Storage) GetLedger(ctx context.Context, uid uuid.UUID, limit, offset int) ([]models.LedgerEntryResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var entries []models.LedgerEntryResponse
+	skipped := 0
+	for i := len(m.ledger) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := m.ledger[i]
+		if entry.UID != uid {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		entries = append(entries, models.LedgerEntryResponse{
+			Order:     entry.OrderID,
+			Amount:    entry.Amount,
+			Reason:    entry.Reason,
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,52 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) AddLoginFailure(ctx context.Context, key string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	since := now.Add(-window)
+	failures := m.loginFailures[key][:0]
+	for _, at := range m.loginFailures[key] {
+		if !at.Before(since) {
+			failures = append(failures, at)
+		}
+	}
+	m.loginFailures[key] = append(failures, now)
+	return len(m.loginFailures[key]), nil
+}
+
+func (m *Storage) GetLoginLockout(ctx context.Context, key string) (models.LoginLockout, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if lockout, ok := m.lockouts[key]; ok {
+		return lockout, nil
+	}
+	return models.LoginLockout{Key: key}, nil
+}
+
+func (m *Storage) SetLoginLockout(ctx context.Context, lockout models.LoginLockout) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lockouts[lockout.Key] = lockout
+	delete(m.loginFailures, lockout.Key)
+	return nil
+}
+
+func (m *Storage) ResetLoginFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginFailures, key)
+	delete(m.lockouts, key)
+	return nil
+}
@@ -0,0 +1,339 @@
+package memory
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
+)
+
+type withdrawal struct {
+	orderID     string
+	uid         uuid.UUID
+	amount      models.Money
+	processedAt time.Time
+}
+
+type balance struct {
+	current   models.Money
+	withdrawn models.Money
+}
+
+// Storage keeps everything in process memory, used when no DATABASE_URI is given
+type Storage struct {
+	mu          sync.RWMutex
+	users       map[string]models.User
+	orders      map[string]models.Order
+	withdrawals map[string]withdrawal
+	balances    map[uuid.UUID]*balance
+	jobs        map[string]*models.AccrualJob
+	served      map[uuid.UUID]time.Time // last job claim per user, for fair scheduling
+	ledger      []models.LedgerEntry
+	sessions    map[uuid.UUID]*models.Session
+
+	loginFailures map[string][]time.Time
+	lockouts      map[string]models.LoginLockout
+	resets        map[string]models.PasswordReset
+	totp          map[uuid.UUID]models.TOTP
+	recoveryCodes map[uuid.UUID]map[string]bool
+	deleted       map[uuid.UUID]time.Time // soft deleted users
+	audit         []models.AuditEntry
+}
+
+func New() *Storage {
+	return &Storage{
+		users:       make(map[string]models.User),
+		orders:      make(map[string]models.Order),
+		withdrawals: make(map[string]withdrawal),
+		balances:    make(map[uuid.UUID]*balance),
+		jobs:        make(map[string]*models.AccrualJob),
+		served:      make(map[uuid.UUID]time.Time),
+		sessions:    make(map[uuid.UUID]*models.Session),
+
+		loginFailures: make(map[string][]time.Time),
+		lockouts:      make(map[string]models.LoginLockout),
+		resets:        make(map[string]models.PasswordReset),
+		totp:          make(map[uuid.UUID]models.TOTP),
+		recoveryCodes: make(map[uuid.UUID]map[string]bool),
+		deleted:       make(map[uuid.UUID]time.Time),
+	}
+}
+
+func (m *Storage) Close() {}
+
+func (m *Storage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Storage) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[login]
+	if !ok {
+		return models.User{}, models.ErrUserNotFound
+	}
+	if _, deleted := m.deleted[user.UID]; deleted {
+		return models.User{}, models.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (m *Storage) GetUserByUUID(ctx context.Context, uid uuid.UUID) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, deleted := m.deleted[uid]; deleted {
+		return models.User{}, models.ErrUserNotFound
+	}
+	for _, user := range m.users {
+		if user.UID == uid {
+			return user, nil
+		}
+	}
+	return models.User{}, models.ErrUserNotFound
+}
+
+func (m *Storage) CreateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[user.Login]; ok {
+		slog.ErrorContext(ctx, "user already exists", "login", user.Login)
+		return nil, models.ErrUserExists
+	}
+	m.users[user.Login] = *user
+	return user, nil
+}
+
+func (m *Storage) SaveOrder(ctx context.Context, user models.User, order models.Order) (models.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if exist, ok := m.orders[order.ID]; ok {
+		if exist.UID == user.UID {
+			slog.ErrorContext(ctx, "order already exists for user", "order", order.ID, "login", user.Login)
+			return exist, models.ErrOrderExists
+		}
+		slog.ErrorContext(ctx, "order already exists for another user", "order", order.ID, "other_uid", exist.UID)
+		return exist, models.ErrOrderBelongsAnotherUser
+	}
+	m.orders[order.ID] = order
+	m.jobs[order.ID] = &models.AccrualJob{
+		OrderID:       order.ID,
+		UID:           order.UID,
+		Stage:         models.AccrualJobRegister,
+		NextAttemptAt: time.Now(),
+		TraceParent:   tracing.TraceParent(ctx),
+	}
+	m.appendAudit(ctx, models.AuditEntry{
+		Action:    models.AuditOrderUpload,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		OrderID:   order.ID,
+		After:     models.AuditValues(map[string]interface{}{"status": order.AccrualStatus}),
+	})
+	return order, nil
+}
+
+func (m *Storage) GetOrders(ctx context.Context, uid uuid.UUID) ([]models.OrderResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []models.OrderResponse
+	for _, order := range m.sortedOrders() {
+		if order.UID == uid {
+			orders = append(orders, orderResponse(order))
+		}
+	}
+	return orders, nil
+}
+
+// GetBalance derives the balance from the ledger and reconciles it against the running totals
+func (m *Storage) GetBalance(ctx context.Context, uid uuid.UUID) (models.BalanceResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var current, withdrawn models.Money
+	for _, entry := range m.ledger {
+		if entry.UID != uid {
+			continue
+		}
+		current += entry.Amount
+		if entry.Reason == models.LedgerReasonWithdrawal {
+			withdrawn -= entry.Amount
+		}
+	}
+
+	bal, ok := m.balances[uid]
+	if !ok {
+		bal = &balance{}
+	}
+	if bal.current != current || bal.withdrawn != withdrawn {
+		slog.WarnContext(ctx, "balance does not match ledger", "uid", uid,
+			"balance_current", bal.current, "balance_withdrawn", bal.withdrawn,
+			"ledger_current", current, "ledger_withdrawn", withdrawn)
+	}
+
+	return models.BalanceResponse{Current: current, Withdrawn: withdrawn}, nil
+}
+
+func (m *Storage) SaveWithdraw(ctx context.Context, user models.User, order models.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bal, ok := m.balances[user.UID]
+	if !ok {
+		bal = &balance{}
+	}
+
+	if bal.current < order.Amount {
+		slog.ErrorContext(ctx, "not enough balance", "uid", user.UID)
+		return models.ErrBalanceWrong
+	}
+
+	if _, ok := m.withdrawals[order.ID]; ok {
+		slog.ErrorContext(ctx, "withdrawal already exists", "order", order.ID)
+		return models.ErrOrderExists
+	}
+
+	m.withdrawals[order.ID] = withdrawal{
+		orderID:     order.ID,
+		uid:         user.UID,
+		amount:      order.Amount,
+		processedAt: order.UploadedAt,
+	}
+	m.balances[user.UID] = bal
+	bal.current -= order.Amount
+	bal.withdrawn += order.Amount
+	m.appendLedger(models.LedgerEntry{
+		UID:     user.UID,
+		OrderID: order.ID,
+		Amount:  -order.Amount,
+		Reason:  models.LedgerReasonWithdrawal,
+	})
+	m.appendAudit(ctx, models.AuditEntry{
+		Action:    models.AuditBalanceWithdraw,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		OrderID:   order.ID,
+		Details:   models.AuditValues(map[string]interface{}{"amount": order.Amount}),
+		Before:    models.AuditValues(map[string]interface{}{"current": bal.current + order.Amount}),
+		After:     models.AuditValues(map[string]interface{}{"current": bal.current}),
+	})
+
+	return nil
+}
+
+func (m *Storage) UpdateOrderStatus(ctx context.Context, orderNumber string, status models.AccrualStatus, amount models.Money) (models.OrderResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[orderNumber]
+	if !ok {
+		slog.ErrorContext(ctx, "cannot update order status, not found", "order", orderNumber)
+		return models.OrderResponse{}, models.ErrOrderNotFound
+	}
+
+	if order.AccrualStatus == status && status.IsFinal() {
+		slog.InfoContext(ctx, "order status unchanged", "order", orderNumber, "status", status)
+		return orderResponse(order), nil
+	}
+
+	if !order.AccrualStatus.CanTransit(status) {
+		slog.ErrorContext(ctx, "order status cannot move", "order", orderNumber, "from", order.AccrualStatus, "to", status)
+		return models.OrderResponse{}, models.ErrOrderStatusTransition
+	}
+
+	if order.AccrualStatus != status {
+		m.appendAudit(ctx, models.AuditEntry{
+			Action:    models.AuditOrderStatus,
+			TargetUID: order.UID,
+			OrderID:   orderNumber,
+			Before:    models.AuditValues(map[string]interface{}{"status": order.AccrualStatus}),
+			After:     models.AuditValues(map[string]interface{}{"status": status, "accrual": amount}),
+		})
+	}
+	order.AccrualStatus = status
+	order.Amount = amount
+	m.orders[orderNumber] = order
+
+	bal, ok := m.balances[order.UID]
+	if !ok {
+		bal = &balance{}
+		m.balances[order.UID] = bal
+	}
+	if status == models.AccrualStatusProcessed && amount > 0 {
+		bal.current += amount
+		m.appendLedger(models.LedgerEntry{
+			UID:     order.UID,
+			OrderID: orderNumber,
+			Amount:  amount,
+			Reason:  models.LedgerReasonAccrual,
+		})
+	}
+
+	return orderResponse(order), nil
+}
+
+// GetWithdrawals returns the user's withdrawals, newest first
+func (m *Storage) GetWithdrawals(ctx context.Context, uid uuid.UUID) ([]models.WithdrawalsResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var withdrawals []models.WithdrawalsResponse
+	for _, w := range m.withdrawals {
+		if w.uid != uid {
+			continue
+		}
+		withdrawals = append(withdrawals, models.WithdrawalsResponse{
+			Number:      w.orderID,
+			Accrual:     w.amount,
+			ProcessedAt: w.processedAt,
+		})
+	}
+	sort.Slice(withdrawals, func(i, j int) bool {
+		return withdrawals[i].ProcessedAt.After(withdrawals[j].ProcessedAt)
+	})
+	return withdrawals, nil
+}
+
+func (m *Storage) GetOrdersByStatus(ctx context.Context, status models.AccrualStatus) ([]models.OrderResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []models.OrderResponse
+	for _, order := range m.sortedOrders() {
+		if order.AccrualStatus == status {
+			orders = append(orders, orderResponse(order))
+		}
+	}
+	return orders, nil
+}
+
+// sortedOrders returns all orders by upload time, caller must hold the lock
+func (m *Storage) sortedOrders() []models.Order {
+	orders := make([]models.Order, 0, len(m.orders))
+	for _, order := range m.orders {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].UploadedAt.Before(orders[j].UploadedAt)
+	})
+	return orders
+}
+
+func orderResponse(order models.Order) models.OrderResponse {
+	return models.OrderResponse{
+		ID:         order.ID,
+		Status:     string(order.AccrualStatus),
+		Amount:     order.Amount,
+		UploadedAt: order.UploadedAt,
+	}
+}
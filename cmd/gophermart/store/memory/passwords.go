@@ -0,0 +1,86 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) UpdatePassword(ctx context.Context, uid uuid.UUID, phash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setPassword(uid, phash)
+	return nil
+}
+
+func (m *Storage) ChangePassword(ctx context.Context, uid uuid.UUID, phash string) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setPassword(uid, phash)
+	return m.revokeUserSessions(uid), nil
+}
+
+func (m *Storage) CreatePasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, r := range m.resets {
+		if r.UID == reset.UID {
+			delete(m.resets, hash)
+		}
+	}
+	m.resets[reset.TokenHash] = reset
+	return nil
+}
+
+func (m *Storage) GetPasswordReset(ctx context.Context, hash string) (models.PasswordReset, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	reset, ok := m.resets[hash]
+	if !ok || !reset.ExpiresAt.After(time.Now()) {
+		return models.PasswordReset{TokenHash: hash}, models.ErrTokenInvalid
+	}
+	return reset, nil
+}
+
+func (m *Storage) ResetPassword(ctx context.Context, hash, phash string) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reset, ok := m.resets[hash]
+	if !ok || !reset.ExpiresAt.After(time.Now()) {
+		return nil, models.ErrTokenInvalid
+	}
+	delete(m.resets, hash)
+
+	m.setPassword(reset.UID, phash)
+	return m.revokeUserSessions(reset.UID), nil
+}
+
+func (m *Storage) setPassword(uid uuid.UUID, phash string) {
+	for login, user := range m.users {
+		if user.UID == uid {
+			user.PHash = phash
+			m.users[login] = user
+			return
+		}
+	}
+}
+
+func (m *Storage) revokeUserSessions(uid uuid.UUID) []uuid.UUID {
+	var sids []uuid.UUID
+	now := time.Now()
+	for _, session := range m.sessions {
+		if session.UID == uid && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			sids = append(sids, session.ID)
+		}
+	}
+	return sids
+}
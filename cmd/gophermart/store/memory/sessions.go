@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) CreateSession(ctx context.Context, session models.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.ID] = &session
+	return nil
+}
+
+func (m *Storage) RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range m.sessions {
+		if session.RevokedAt != nil {
+			continue
+		}
+		if session.RefreshHash == oldHash && session.ExpiresAt.After(now) {
+			session.PreviousHash = session.RefreshHash
+			session.RefreshHash = newHash
+			session.ExpiresAt = expiresAt
+			return *session, nil
+		}
+		if session.PreviousHash == oldHash {
+			session.RevokedAt = &now
+			slog.WarnContext(ctx, "refresh token reused, session revoked", "sid", session.ID)
+			return *session, models.ErrTokenRevoked
+		}
+	}
+	return models.Session{}, models.ErrTokenInvalid
+}
+
+func (m *Storage) RevokeSession(ctx context.Context, sid uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[sid]; ok && session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+	}
+	return nil
+}
+
+func (m *Storage) IsSessionRevoked(ctx context.Context, sid uuid.UUID) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[sid]
+	if !ok {
+		return true, nil
+	}
+	return session.RevokedAt != nil, nil
+}
@@ -0,0 +1,28 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) Stats(ctx context.Context) (models.Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := models.Stats{
+		QueueDepth: make(map[models.AccrualJobStage]int),
+		Orders:     make(map[models.AccrualStatus]int),
+	}
+	for _, job := range m.jobs {
+		stats.QueueDepth[job.Stage]++
+	}
+	for _, order := range m.orders {
+		stats.Orders[order.AccrualStatus]++
+	}
+	for _, w := range m.withdrawals {
+		stats.Withdrawals++
+		stats.Withdrawn += w.amount
+	}
+	return stats, nil
+}
@@ -0,0 +1,96 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) GetTOTP(ctx context.Context, uid uuid.UUID) (models.TOTP, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if totp, ok := m.totp[uid]; ok {
+		return totp, nil
+	}
+	return models.TOTP{UID: uid}, nil
+}
+
+func (m *Storage) SaveTOTPSecret(ctx context.Context, uid uuid.UUID, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.totp[uid].Enabled {
+		return models.ErrTOTPEnabled
+	}
+	m.totp[uid] = models.TOTP{UID: uid, Secret: secret}
+	return nil
+}
+
+func (m *Storage) ListTOTPSecrets(ctx context.Context) ([]models.TOTP, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	secrets := make([]models.TOTP, 0, len(m.totp))
+	for _, totp := range m.totp {
+		secrets = append(secrets, totp)
+	}
+	return secrets, nil
+}
+
+func (m *Storage) ReplaceTOTPSecret(ctx context.Context, uid uuid.UUID, old, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if totp, ok := m.totp[uid]; ok && totp.Secret == old {
+		totp.Secret = secret
+		m.totp[uid] = totp
+	}
+	return nil
+}
+
+func (m *Storage) EnableTOTP(ctx context.Context, uid uuid.UUID, step int64, recoveryHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totp[uid]
+	if !ok || totp.Enabled {
+		return models.ErrTOTPEnabled
+	}
+	totp.Enabled = true
+	totp.LastStep = step
+	m.totp[uid] = totp
+
+	codes := make(map[string]bool, len(recoveryHashes))
+	for _, hash := range recoveryHashes {
+		codes[hash] = true
+	}
+	m.recoveryCodes[uid] = codes
+	return nil
+}
+
+func (m *Storage) UseTOTPStep(ctx context.Context, uid uuid.UUID, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totp[uid]
+	if !ok || !totp.Enabled || totp.LastStep >= step {
+		return models.ErrTOTPCodeInvalid
+	}
+	totp.LastStep = step
+	m.totp[uid] = totp
+	return nil
+}
+
+func (m *Storage) UseRecoveryCode(ctx context.Context, uid uuid.UUID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.recoveryCodes[uid][hash] {
+		return models.ErrTOTPCodeInvalid
+	}
+	delete(m.recoveryCodes[uid], hash)
+	return nil
+}
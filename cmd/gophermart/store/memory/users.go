@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (m *Storage) DeleteUser(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.deleted[uid]; ok {
+		return nil, models.ErrUserNotFound
+	}
+	if _, ok := m.userLogin(uid); !ok {
+		return nil, models.ErrUserNotFound
+	}
+	m.deleted[uid] = time.Now()
+
+	for id, job := range m.jobs {
+		if job.UID == uid {
+			delete(m.jobs, id)
+		}
+	}
+	return m.revokeUserSessions(uid), nil
+}
+
+func (m *Storage) AnonymizeUsers(ctx context.Context, deletedBefore time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for uid, deletedAt := range m.deleted {
+		if !deletedAt.Before(deletedBefore) {
+			continue
+		}
+		login, ok := m.userLogin(uid)
+		if !ok || login == "deleted-"+uid.String() {
+			continue
+		}
+
+		user := m.users[login]
+		delete(m.users, login)
+		user.Login = "deleted-" + uid.String()
+		user.PHash = ""
+		m.users[user.Login] = user
+
+		for sid, session := range m.sessions {
+			if session.UID == uid {
+				delete(m.sessions, sid)
+			}
+		}
+		for hash, reset := range m.resets {
+			if reset.UID == uid {
+				delete(m.resets, hash)
+			}
+		}
+		delete(m.totp, uid)
+		delete(m.recoveryCodes, uid)
+		n++
+	}
+	return n, nil
+}
+
+func (m *Storage) userLogin(uid uuid.UUID) (string, bool) {
+	for login, user := range m.users {
+		if user.UID == uid {
+			return login, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS accrual_jobs (
+    order_id text NOT NULL PRIMARY KEY,
+    stage text NOT NULL DEFAULT 'REGISTER',
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    attempts int NOT NULL DEFAULT 0,
+    last_error text DEFAULT NULL,
+    FOREIGN KEY (order_id) REFERENCES orders (id)
+);
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_stage_next_attempt_idx ON accrual_jobs (stage, next_attempt_at);
+
+INSERT INTO
+    accrual_jobs (order_id, stage)
+        SELECT id, CASE WHEN status = 'NEW' THEN 'REGISTER' ELSE 'POLL' END
+        FROM orders
+        WHERE status IN ('NEW', 'PROCESSING')
+ON CONFLICT DO NOTHING;
+
+-- +goose Down
+DROP TABLE accrual_jobs;
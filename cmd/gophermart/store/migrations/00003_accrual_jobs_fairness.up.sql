@@ -0,0 +1,14 @@
+-- +goose Up
+ALTER TABLE accrual_jobs ADD COLUMN IF NOT EXISTS uid uuid;
+ALTER TABLE accrual_jobs ADD COLUMN IF NOT EXISTS claimed_at timestamptz DEFAULT NULL;
+
+UPDATE accrual_jobs j SET uid = o.uid FROM orders o WHERE o.id = j.order_id;
+
+ALTER TABLE accrual_jobs ALTER COLUMN uid SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_uid_claimed_idx ON accrual_jobs (uid, claimed_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS accrual_jobs_uid_claimed_idx;
+ALTER TABLE accrual_jobs DROP COLUMN claimed_at;
+ALTER TABLE accrual_jobs DROP COLUMN uid;
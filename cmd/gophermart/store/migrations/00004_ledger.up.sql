@@ -0,0 +1,40 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS ledger (
+    id bigserial NOT NULL PRIMARY KEY,
+    uid uuid NOT NULL,
+    order_id text NOT NULL,
+    amount bigint NOT NULL,
+    reason text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (reason, order_id),
+    FOREIGN KEY (uid) REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_uid_id_idx ON ledger (uid, id);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER ledger_append_only BEFORE UPDATE OR DELETE ON ledger
+    FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+
+INSERT INTO
+    ledger (uid, order_id, amount, reason, created_at)
+        SELECT uid, id, amount, 'ACCRUAL', updated_at
+        FROM orders
+        WHERE status = 'PROCESSED' AND amount > 0;
+
+INSERT INTO
+    ledger (uid, order_id, amount, reason)
+        SELECT uid, order_id, -amount, 'WITHDRAWAL'
+        FROM withdrawals
+        WHERE amount > 0;
+
+-- +goose Down
+DROP TABLE ledger;
+DROP FUNCTION IF EXISTS ledger_append_only();
@@ -0,0 +1,8 @@
+-- +goose Up
+-- NOT VALID keeps the migration working on balances already driven negative,
+-- the check still applies to every new write
+ALTER TABLE balances
+    ADD CONSTRAINT balances_non_negative CHECK (current_balance >= 0 AND withdrawn >= 0) NOT VALID;
+
+-- +goose Down
+ALTER TABLE balances DROP CONSTRAINT IF EXISTS balances_non_negative;
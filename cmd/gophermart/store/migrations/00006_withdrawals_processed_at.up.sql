@@ -0,0 +1,10 @@
+-- +goose Up
+-- withdrawals are paid with new order numbers, which are never uploaded as orders
+ALTER TABLE withdrawals DROP CONSTRAINT IF EXISTS withdrawals_order_id_fkey;
+ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS processed_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS withdrawals_uid_processed_at_idx ON withdrawals (uid, processed_at DESC);
+
+-- +goose Down
+DROP INDEX IF EXISTS withdrawals_uid_processed_at_idx;
+ALTER TABLE withdrawals DROP COLUMN processed_at;
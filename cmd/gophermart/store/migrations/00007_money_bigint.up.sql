@@ -0,0 +1,16 @@
+-- +goose Up
+-- amounts are kopecks, balances used to keep them in float columns
+ALTER TABLE balances
+    ALTER COLUMN current_balance TYPE bigint USING round(current_balance)::bigint,
+    ALTER COLUMN withdrawn TYPE bigint USING round(withdrawn)::bigint;
+
+ALTER TABLE orders ALTER COLUMN amount TYPE bigint;
+ALTER TABLE withdrawals ALTER COLUMN amount TYPE bigint;
+
+-- +goose Down
+ALTER TABLE withdrawals ALTER COLUMN amount TYPE int;
+ALTER TABLE orders ALTER COLUMN amount TYPE int;
+
+ALTER TABLE balances
+    ALTER COLUMN current_balance TYPE float,
+    ALTER COLUMN withdrawn TYPE float;
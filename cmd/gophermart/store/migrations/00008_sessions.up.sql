@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS sessions (
+    id uuid NOT NULL PRIMARY KEY,
+    uid uuid NOT NULL,
+    refresh_hash text UNIQUE NOT NULL,
+    previous_hash text DEFAULT NULL,
+    expires_at timestamptz NOT NULL,
+    revoked_at timestamptz DEFAULT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    FOREIGN KEY (uid) REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS sessions_previous_hash_idx ON sessions (previous_hash);
+CREATE INDEX IF NOT EXISTS sessions_uid_idx ON sessions (uid);
+
+-- +goose Down
+DROP TABLE sessions;
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS login_failures (
+    id bigserial NOT NULL PRIMARY KEY,
+    key text NOT NULL,
+    failed_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_key_idx ON login_failures (key, failed_at);
+CREATE INDEX IF NOT EXISTS login_failures_failed_at_idx ON login_failures (failed_at);
+
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    key text NOT NULL PRIMARY KEY,
+    level int NOT NULL DEFAULT 0,
+    locked_until timestamptz NOT NULL
+);
+
+-- +goose Down
+DROP TABLE login_lockouts;
+DROP TABLE login_failures;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS password_resets (
+    token_hash text NOT NULL PRIMARY KEY,
+    uid uuid NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz DEFAULT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    FOREIGN KEY (uid) REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_uid_idx ON password_resets (uid);
+
+-- +goose Down
+DROP TABLE password_resets;
@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS user_totp (
+    uid uuid NOT NULL PRIMARY KEY,
+    secret text NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_step bigint NOT NULL DEFAULT 0,
+    FOREIGN KEY (uid) REFERENCES users (uid)
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    uid uuid NOT NULL,
+    code_hash text NOT NULL,
+    used_at timestamptz DEFAULT NULL,
+    PRIMARY KEY (uid, code_hash),
+    FOREIGN KEY (uid) REFERENCES users (uid)
+);
+
+-- +goose Down
+DROP TABLE recovery_codes;
+DROP TABLE user_totp;
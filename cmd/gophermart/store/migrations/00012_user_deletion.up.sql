@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamptz DEFAULT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS anonymized_at timestamptz DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted AND anonymized_at IS NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS users_deleted_at_idx;
+ALTER TABLE users DROP COLUMN anonymized_at;
+ALTER TABLE users DROP COLUMN deleted_at;
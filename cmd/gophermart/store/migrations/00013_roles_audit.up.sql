@@ -0,0 +1,32 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('user', 'support', 'admin'));
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial NOT NULL PRIMARY KEY,
+    action text NOT NULL,
+    actor_uid uuid DEFAULT NULL,
+    target_uid uuid DEFAULT NULL,
+    order_id text DEFAULT NULL,
+    details jsonb DEFAULT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_target_uid_idx ON audit_log (target_uid, id);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+-- +goose Down
+DROP TABLE audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,18 @@
+-- +goose Up
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS ip text DEFAULT NULL;
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS request_id text DEFAULT NULL;
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS before jsonb DEFAULT NULL;
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS after jsonb DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_uid_idx ON audit_log (actor_uid, id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, id);
+CREATE INDEX IF NOT EXISTS audit_log_order_id_idx ON audit_log (order_id, id) WHERE order_id IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS audit_log_order_id_idx;
+DROP INDEX IF EXISTS audit_log_action_idx;
+DROP INDEX IF EXISTS audit_log_actor_uid_idx;
+ALTER TABLE audit_log DROP COLUMN after;
+ALTER TABLE audit_log DROP COLUMN before;
+ALTER TABLE audit_log DROP COLUMN request_id;
+ALTER TABLE audit_log DROP COLUMN ip;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- W3C traceparent of the request that queued the job, accrual spans link back to it
+ALTER TABLE accrual_jobs ADD COLUMN IF NOT EXISTS trace_parent text DEFAULT NULL;
+
+-- +goose Down
+ALTER TABLE accrual_jobs DROP COLUMN trace_parent;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- logins do not belong in the append-only audit log, they would outlive the
+-- anonymization of deleted accounts; entries written before are scrubbed once
+ALTER TABLE audit_log DISABLE TRIGGER audit_log_append_only;
+UPDATE audit_log SET after = after - 'login' WHERE action = 'user.register' AND after ? 'login';
+UPDATE audit_log SET details = details - 'login' WHERE action = 'login.failure' AND details ? 'login';
+UPDATE audit_log SET details = jsonb_set(details, '{key}', '"login:[REDACTED]"')
+    WHERE action = 'login.lockout' AND details->>'key' LIKE 'login:%';
+ALTER TABLE audit_log ENABLE TRIGGER audit_log_append_only;
+
+-- +goose Down
+-- scrubbed logins cannot be restored
@@ -0,0 +1,163 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// UpdatePassword replaces the password hash keeping the sessions, used to rehash with a higher cost
+func (p *Storage) UpdatePassword(ctx context.Context, uid uuid.UUID, phash string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(ctx, "UPDATE users SET password=$2 WHERE uid=$1", uid, phash)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot update password", "uid", uid, "err", err)
+		return err
+	}
+	return nil
+}
+
+// ChangePassword replaces the password hash and revokes every session of the user,
+// the ids of the revoked sessions are returned
+func (p *Storage) ChangePassword(ctx context.Context, uid uuid.UUID, phash string) ([]uuid.UUID, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	sids, err := changePassword(ctx, tx, uid, phash)
+	if err != nil {
+		return nil, err
+	}
+	return sids, tx.Commit(ctx)
+}
+
+func (p *Storage) CreatePasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// only the latest reset token of the user works
+	_, err = tx.Exec(ctx, "UPDATE password_resets SET used_at=now() WHERE uid=$1 AND used_at IS NULL", reset.UID)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot expire password resets", "uid", reset.UID, "err", err)
+		return err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO password_resets (token_hash, uid, expires_at) VALUES ($1, $2, $3)",
+		reset.TokenHash, reset.UID, reset.ExpiresAt,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot create password reset", "uid", reset.UID, "err", err)
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetPasswordReset returns an unused and unexpired reset token, ErrTokenInvalid otherwise
+func (p *Storage) GetPasswordReset(ctx context.Context, hash string) (models.PasswordReset, error) {
+	reset := models.PasswordReset{TokenHash: hash}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(
+		ctx,
+		"SELECT uid, expires_at FROM password_resets WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()",
+		hash,
+	).Scan(&reset.UID, &reset.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return reset, models.ErrTokenInvalid
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get password reset", "err", err)
+		return reset, err
+	}
+	return reset, nil
+}
+
+// ResetPassword uses up the reset token and changes the password like ChangePassword
+func (p *Storage) ResetPassword(ctx context.Context, hash, phash string) ([]uuid.UUID, error) {
+	var uid uuid.UUID
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(
+		ctx,
+		`UPDATE password_resets SET used_at=now()
+		WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()
+		RETURNING uid`,
+		hash,
+	).Scan(&uid)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrTokenInvalid
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot use password reset", "err", err)
+		return nil, err
+	}
+
+	sids, err := changePassword(ctx, tx, uid, phash)
+	if err != nil {
+		return nil, err
+	}
+	return sids, tx.Commit(ctx)
+}
+
+func changePassword(ctx context.Context, tx pgx.Tx, uid uuid.UUID, phash string) ([]uuid.UUID, error) {
+	_, err := tx.Exec(ctx, "UPDATE users SET password=$2 WHERE uid=$1", uid, phash)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot change password", "uid", uid, "err", err)
+		return nil, err
+	}
+	return revokeUserSessions(ctx, tx, uid)
+}
+
+// revokeUserSessions revokes every live session of the user inside the caller's tx
+func revokeUserSessions(ctx context.Context, tx pgx.Tx, uid uuid.UUID) ([]uuid.UUID, error) {
+	var sids []uuid.UUID
+
+	rows, err := tx.Query(ctx, "UPDATE sessions SET revoked_at=now() WHERE uid=$1 AND revoked_at IS NULL RETURNING id", uid)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot revoke sessions", "uid", uid, "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sid uuid.UUID
+		if err := rows.Scan(&sid); err != nil {
+			slog.ErrorContext(ctx, "cannot scan", "err", err)
+			continue
+		}
+		sids = append(sids, sid)
+	}
+	return sids, rows.Err()
+}
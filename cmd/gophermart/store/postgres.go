@@ -4,16 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 
-	log "github.com/go-pkgz/lgr"
 	"github.com/google/uuid"
 	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
-	"github.com/stsg/gophermart/cmd/gophermart/lib"
 	"github.com/stsg/gophermart/cmd/gophermart/models"
+	"github.com/stsg/gophermart/cmd/gophermart/tracing"
 )
 
 type Storage struct {
@@ -33,15 +33,19 @@ func (p *Storage) Ping(ctx context.Context) error {
 func New(cfg *Config) (*Storage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
 	defer cancel()
-	pool, err := pgxpool.New(ctx, cfg.ConnectionString)
+	poolCfg, err := pgxpool.ParseConfig(cfg.ConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("postgres config: %w", err)
+	}
+	poolCfg.ConnConfig.Tracer = tracing.QueryTracer{}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, fmt.Errorf("postgres connect: %w", err)
 	}
 
-	if !lib.IsTableExist(pool, "users") {
-		if err := migrate(pool, cfg.MigrationVersion); err != nil {
-			return nil, err
-		}
+	if err := migrate(pool, cfg.MigrationVersion); err != nil {
+		return nil, err
 	}
 
 	return &Storage{cfg: cfg, db: pool}, nil
@@ -52,10 +56,11 @@ func (p *Storage) GetUserByLogin(ctx context.Context, login string) (models.User
 
 	err := p.db.QueryRow(
 		ctx,
-		"SELECT uid, login, password FROM users WHERE login=$1", login).Scan(
+		"SELECT uid, login, password, role FROM users WHERE login=$1 AND NOT deleted", login).Scan(
 		&user.UID,
 		&user.Login,
 		&user.PHash,
+		&user.Role,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -72,10 +77,11 @@ func (p *Storage) GetUserByUUID(ctx context.Context, uid uuid.UUID) (models.User
 
 	err := p.db.QueryRow(
 		ctx,
-		"SELECT uid, login, password FROM users WHERE uid=$1", uid).Scan(
+		"SELECT uid, login, password, role FROM users WHERE uid=$1 AND NOT deleted", uid).Scan(
 		&user.UID,
 		&user.Login,
 		&user.PHash,
+		&user.Role,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -90,18 +96,19 @@ func (p *Storage) GetUserByUUID(ctx context.Context, uid uuid.UUID) (models.User
 func (p *Storage) CreateUser(ctx context.Context, user *models.User) (*models.User, error) {
 	_, err := p.db.Exec(
 		ctx,
-		"INSERT INTO users (uid, login, password) VALUES ($1, $2, $3)",
+		"INSERT INTO users (uid, login, password, role) VALUES ($1, $2, $3, $4)",
 		user.UID,
 		user.Login,
 		user.PHash,
+		user.Role,
 	)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
-			log.Printf("[ERROR] user %s already exists %v", user.Login, err)
+			slog.ErrorContext(ctx, "user already exists", "login", user.Login, "err", err)
 			return nil, models.ErrUserExists
 		}
-		log.Printf("[ERROR] cannot create user %s %v", user.Login, err)
+		slog.ErrorContext(ctx, "cannot create user", "login", user.Login, "err", err)
 		return nil, err
 	}
 	return user, nil
@@ -120,14 +127,21 @@ func (p *Storage) SaveOrder(ctx context.Context, user models.User, order models.
 	)
 	if err == nil {
 		if user.UID == order.UID {
-			log.Printf("[ERROR] order %s already exist for user %s", order.ID, user.Login)
+			slog.ErrorContext(ctx, "order already exists for user", "order", order.ID, "login", user.Login)
 			return order, models.ErrOrderExists
 		}
-		log.Printf("[ERROR] order %s already exist for another user %s", order.ID, order.UID)
+		slog.ErrorContext(ctx, "order already exists for another user", "order", order.ID, "other_uid", order.UID)
 		return order, models.ErrOrderBelongsAnotherUser
 	}
 
-	_, err = p.db.Exec(ctx, "INSERT INTO orders (id, uid, amount, status, updated_at) VALUES ($1, $2, $3, $4, $5)",
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return order, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "INSERT INTO orders (id, uid, amount, status, updated_at) VALUES ($1, $2, $3, $4, $5)",
 		order.ID,
 		order.UID,
 		order.Amount,
@@ -135,7 +149,35 @@ func (p *Storage) SaveOrder(ctx context.Context, user models.User, order models.
 		order.UploadedAt,
 	)
 	if err != nil {
-		log.Printf("[ERROR] cannot save order %s %v", user.Login, err)
+		slog.ErrorContext(ctx, "cannot save order", "login", user.Login, "err", err)
+		return order, err
+	}
+
+	// the accrual job is queued in the same tx, so an accepted order is never lost
+	_, err = tx.Exec(ctx, "INSERT INTO accrual_jobs (order_id, uid, stage, trace_parent) VALUES ($1, $2, $3, $4)",
+		order.ID,
+		order.UID,
+		models.AccrualJobRegister,
+		nullString(tracing.TraceParent(ctx)),
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot queue accrual job", "order", order.ID, "err", err)
+		return order, err
+	}
+
+	err = appendAudit(ctx, tx, models.AuditEntry{
+		Action:    models.AuditOrderUpload,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		OrderID:   order.ID,
+		After:     models.AuditValues(map[string]interface{}{"status": order.AccrualStatus}),
+	})
+	if err != nil {
+		return order, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
 		return order, err
 	}
 	return order, nil
@@ -149,116 +191,137 @@ func (p *Storage) GetOrders(ctx context.Context, uid uuid.UUID) ([]models.OrderR
 
 	rows, err := p.db.Query(
 		ctx,
-		"SELECT id, uid, amount, status, updated_at FROM orders WHERE uid=$1 order by updated_at",
+		"SELECT id, uid, amount, status, updated_at FROM orders WHERE uid=$1 AND NOT deleted order by updated_at",
 		uid,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return []models.OrderResponse{}, models.ErrOrderNotFound
 		}
-		log.Printf("[ERROR] cannot get orders %v", err)
+		slog.ErrorContext(ctx, "cannot get orders", "err", err)
 		return []models.OrderResponse{}, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var amount int64
 		order := models.OrderResponse{}
-		err := rows.Scan(&order.ID, &uid, &amount, &order.Status, &order.UploadedAt)
+		err := rows.Scan(&order.ID, &uid, &order.Amount, &order.Status, &order.UploadedAt)
 		if err != nil {
-			log.Printf("[ERROR] cannot scan %v", err)
+			slog.ErrorContext(ctx, "cannot scan", "err", err)
 			continue
 		}
-		order.Amount = lib.RoundFloat(float64(amount)/100.00, 2)
 		orders = append(orders, order)
 	}
 	return orders, nil
 }
 
+// GetBalance derives the balance from the ledger and reconciles it
+// against the running totals kept in balances
 func (p *Storage) GetBalance(ctx context.Context, uid uuid.UUID) (models.BalanceResponse, error) {
-	var current int64
-	var withdrawn int64
-	var balance models.BalanceResponse
+	var current models.Money
+	var withdrawn models.Money
 
 	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
 	defer cancel()
 
-	err := p.db.QueryRow(ctx, "SELECT current_balance, withdrawn FROM balances WHERE uid=$1 LIMIT 1", uid).Scan(&current, &withdrawn)
-	if err == pgx.ErrNoRows {
-		log.Printf("[ERROR] no balance for user %s %v", uid, err)
-		return models.BalanceResponse{}, models.ErrBalanceNotFound
-	}
-
+	err := p.db.QueryRow(
+		ctx,
+		"SELECT COALESCE(SUM(amount), 0)::bigint, COALESCE(-SUM(amount) FILTER (WHERE reason='WITHDRAWAL'), 0)::bigint FROM ledger WHERE uid=$1",
+		uid,
+	).Scan(&current, &withdrawn)
 	if err != nil {
-		log.Printf("[ERROR] cannot get balance %v", err)
+		slog.ErrorContext(ctx, "cannot get balance", "err", err)
 		return models.BalanceResponse{}, err
 	}
 
-	balance.Current = lib.RoundFloat(float64(current)/100.00, 2)
-	balance.Withdrawn = lib.RoundFloat(float64(withdrawn)/100.00, 2)
+	var totalCurrent, totalWithdrawn models.Money
+	err = p.db.QueryRow(ctx, "SELECT current_balance, withdrawn FROM balances WHERE uid=$1 LIMIT 1", uid).Scan(&totalCurrent, &totalWithdrawn)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		slog.ErrorContext(ctx, "cannot get balance totals", "err", err)
+		return models.BalanceResponse{}, err
+	}
+	if totalCurrent != current || totalWithdrawn != withdrawn {
+		slog.WarnContext(ctx, "balance does not match ledger", "uid", uid,
+			"balance_current", totalCurrent, "balance_withdrawn", totalWithdrawn,
+			"ledger_current", current, "ledger_withdrawn", withdrawn)
+	}
 
-	return balance, err
+	return models.BalanceResponse{Current: current, Withdrawn: withdrawn}, nil
 }
 
-// TODO: проверить работу
-// списание баллов в счет оплаты нового заказа
-// здесь проблема с балансом
-// если баланс меньше суммы списания, то списание не производится
+// SaveWithdraw debits the user balance and records the withdrawal in one tx.
+// The balance check and the debit are a single conditional update, the row lock
+// it takes serializes concurrent withdrawals of the same user.
 func (p *Storage) SaveWithdraw(ctx context.Context, user models.User, order models.Order) (err error) {
-	balance := models.Balance{}
-	// accrual := models.Accrual{}
-
 	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
 	defer cancel()
 
 	tx, err := p.db.Begin(ctx)
 	if err != nil {
-		log.Printf("[ERROR] cannot begin tx %v", err)
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	bal, err := p.GetBalance(ctx, user.UID)
-	if err != nil {
-		log.Printf("[ERROR] cannot get balance %v", err)
-		return models.ErrBalanceNotFound
-	}
-
-	if bal.Current < lib.RoundFloat(float64(order.Amount)/100.00, 2) {
-		log.Printf("[ERROR] not enough balance %v", err)
+	var current models.Money
+	err = tx.QueryRow(
+		ctx,
+		"UPDATE balances SET current_balance=current_balance-$1, withdrawn=withdrawn+$1 WHERE uid=$2 AND current_balance>=$1 RETURNING current_balance",
+		order.Amount, user.UID,
+	).Scan(&current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		slog.ErrorContext(ctx, "not enough balance to withdraw", "login", user.Login, "order", order.ID)
 		return models.ErrBalanceWrong
 	}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.CheckViolation {
+			slog.ErrorContext(ctx, "not enough balance", "order", order.ID, "err", err)
+			return models.ErrBalanceWrong
+		}
+		slog.ErrorContext(ctx, "cannot update balance for order status", "order", order.ID, "err", err)
+		return err
+	}
 
 	_, err = tx.Exec(
 		ctx,
-		"INSERT INTO withdrawals (order_id, uid, amount) VALUES ($1, $2, $3)",
+		"INSERT INTO withdrawals (order_id, uid, amount, processed_at) VALUES ($1, $2, $3, $4)",
 		order.ID,
 		user.UID,
 		order.Amount,
+		order.UploadedAt,
 	)
 	if err != nil {
-		log.Printf("[ERROR] cannot save withdrawal %v", err)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			slog.ErrorContext(ctx, "withdrawal already exists", "order", order.ID, "err", err)
+			return models.ErrOrderExists
+		}
+		slog.ErrorContext(ctx, "cannot save withdrawal", "err", err)
 		return err
 	}
 
-	_, err = tx.Exec(
-		ctx,
-		"UPDATE balances SET current_balance=current_balance-$1, withdrawn=withdrawn+$1 WHERE uid=$2",
-		order.Amount, user.UID,
-	)
+	err = appendLedger(ctx, tx, models.LedgerEntry{
+		UID:     user.UID,
+		OrderID: order.ID,
+		Amount:  -order.Amount,
+		Reason:  models.LedgerReasonWithdrawal,
+	})
 	if err != nil {
-		log.Printf("[ERROR] cannot update balance for %s status %v", order.ID, err)
 		return err
 	}
 
-	// err = tx.QueryRow(
-	// 	ctx,
-	// 	"UPDATE balances SET current_balance=current_balance-$1, withdrawn=withdrawn+$1 WHERE current_balance>=$1 AND uid=$2 RETURNING uid, current_balance, withdrawn",
-	// 	order.Amount, user.UID,
-	// ).Scan(&balance.UID, &balance.Current, &balance.Withdrawn)
-	// if err != nil {
-	// 	log.Printf("[ERROR] cannot update balance for %s status %v", order.ID, err)
-	// 	return models.ErrBalanceWrong
-	// }
+	err = appendAudit(ctx, tx, models.AuditEntry{
+		Action:    models.AuditBalanceWithdraw,
+		ActorUID:  user.UID,
+		TargetUID: user.UID,
+		OrderID:   order.ID,
+		Details:   models.AuditValues(map[string]interface{}{"amount": order.Amount}),
+		Before:    models.AuditValues(map[string]interface{}{"current": current + order.Amount}),
+		After:     models.AuditValues(map[string]interface{}{"current": current}),
+	})
+	if err != nil {
+		return err
+	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
@@ -270,76 +333,146 @@ func (p *Storage) SaveWithdraw(ctx context.Context, user models.User, order mode
 
 // func (p *Storage) GetBalanceByUID(ctx context.Context, uid uuid.UUID) (models.BalanceResponse, error) {
 
-func (p *Storage) UpdateOrderStatus(ctx context.Context, orderNumber string, status models.AccrualStatus, amount int64) (models.OrderResponse, error) {
+// UpdateOrderStatus moves the order to the status and, on the transition into
+// PROCESSED, credits the accrual to the user balance in the same tx.
+// Repeating a final status is a no-op, so a duplicate poll never credits twice.
+func (p *Storage) UpdateOrderStatus(ctx context.Context, orderNumber string, status models.AccrualStatus, amount models.Money) (models.OrderResponse, error) {
 	var uid uuid.UUID
+	var current models.AccrualStatus
 
 	order := models.OrderResponse{}
 
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
 	tx, err := p.db.Begin(ctx)
 	if err != nil {
-		log.Printf("[ERROR] cannot begin tx %v", err)
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
 		return order, err
 	}
 	defer tx.Rollback(ctx)
 
 	err = tx.QueryRow(
 		ctx,
-		"UPDATE orders SET status=$2, amount=$3 WHERE id=$1 RETURNING id, uid, amount, status, updated_at",
+		"SELECT id, uid, amount, status, updated_at FROM orders WHERE id=$1 FOR UPDATE",
+		orderNumber,
+	).Scan(&order.ID, &uid, &order.Amount, &current, &order.UploadedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		slog.ErrorContext(ctx, "cannot update order status, not found", "order", orderNumber)
+		return order, models.ErrOrderNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get order status", "order", orderNumber, "err", err)
+		return order, err
+	}
+
+	if current == status && status.IsFinal() {
+		slog.InfoContext(ctx, "order status unchanged", "order", orderNumber, "status", status)
+		order.Status = string(current)
+		return order, nil
+	}
+
+	if !current.CanTransit(status) {
+		slog.ErrorContext(ctx, "order status cannot move", "order", orderNumber, "from", current, "to", status)
+		return order, models.ErrOrderStatusTransition
+	}
+
+	err = tx.QueryRow(
+		ctx,
+		"UPDATE orders SET status=$2, amount=$3 WHERE id=$1 RETURNING amount, status",
 		orderNumber, status, amount,
-	).Scan(&order.ID, &uid, &order.Amount, &order.Status, &order.UploadedAt)
+	).Scan(&order.Amount, &order.Status)
 	if err != nil {
-		log.Printf("[ERROR] cannot update order %s status %v", orderNumber, err)
+		slog.ErrorContext(ctx, "cannot update order status", "order", orderNumber, "err", err)
 		return order, err
 	}
 
+	var credit models.Money
+	if status == models.AccrualStatusProcessed {
+		credit = amount
+	}
+
 	_, err = tx.Exec(
 		ctx,
 		"INSERT INTO balances (uid, current_balance, withdrawn) VALUES ($1, $2, $3) ON CONFLICT (uid) DO UPDATE SET current_balance = balances.current_balance + $2",
-		uid, amount, 0,
+		uid, credit, 0,
 	)
 	if err != nil {
-		log.Printf("[ERROR] cannot update balance for %s status %v", orderNumber, err)
+		slog.ErrorContext(ctx, "cannot update balance for order status", "order", orderNumber, "err", err)
+		return order, err
+	}
+
+	if credit > 0 {
+		err = appendLedger(ctx, tx, models.LedgerEntry{
+			UID:     uid,
+			OrderID: orderNumber,
+			Amount:  credit,
+			Reason:  models.LedgerReasonAccrual,
+		})
+		if err != nil {
+			return order, err
+		}
+	}
+
+	if current != status {
+		err = appendAudit(ctx, tx, models.AuditEntry{
+			Action:    models.AuditOrderStatus,
+			TargetUID: uid,
+			OrderID:   orderNumber,
+			Before:    models.AuditValues(map[string]interface{}{"status": current}),
+			After:     models.AuditValues(map[string]interface{}{"status": status, "accrual": order.Amount}),
+		})
+		if err != nil {
+			return order, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot commit order status", "order", orderNumber, "err", err)
 		return order, err
 	}
 
 	return order, nil
 }
 
+// GetWithdrawals returns the user's withdrawals, newest first
 func (p *Storage) GetWithdrawals(ctx context.Context, uid uuid.UUID) ([]models.WithdrawalsResponse, error) {
-	var orders []models.WithdrawalsResponse
+	var withdrawals []models.WithdrawalsResponse
 
-	rows, err := p.db.Query(ctx, "SELECT id, amount, updated_at FROM orders WHERE uid=$1 AND amount < 0", uid)
-	if errors.Is(err, pgx.ErrNoRows) {
-		log.Printf("[ERROR] no orders %v", err)
-		return []models.WithdrawalsResponse{}, models.ErrOrderNotFound
-	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	rows, err := p.db.Query(
+		ctx,
+		"SELECT order_id, amount, processed_at FROM withdrawals WHERE uid=$1 AND NOT deleted ORDER BY processed_at DESC",
+		uid,
+	)
 	if err != nil {
-		log.Printf("[ERROR] cannot get orders %v", err)
+		slog.ErrorContext(ctx, "cannot get withdrawals", "err", err)
 		return []models.WithdrawalsResponse{}, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var amount int64
-		order := models.WithdrawalsResponse{}
-		err := rows.Scan(&order.Number, &amount, &order.ProcessedAt)
+		withdrawal := models.WithdrawalsResponse{}
+		err := rows.Scan(&withdrawal.Number, &withdrawal.Accrual, &withdrawal.ProcessedAt)
 		if err != nil {
-			log.Printf("[ERROR] cannot get order %v", err)
+			slog.ErrorContext(ctx, "cannot get withdrawal", "err", err)
 			continue
 		}
-		order.Accrual = lib.RoundFloat(float64(amount)/100.00, 2)
-		orders = append(orders, order)
+		withdrawals = append(withdrawals, withdrawal)
 	}
-	return orders, err
+	return withdrawals, rows.Err()
 }
 
 func (p *Storage) GetOrdersByStatus(ctx context.Context, status models.AccrualStatus) ([]models.OrderResponse, error) {
 	var orders []models.OrderResponse
 	rows, err := p.db.Query(
 		ctx,
-		"SELECT id, uid, amount, status, updated_at FROM orders WHERE status=$1 and amount > 0 ORDER BY updated_at", status,
+		"SELECT id, amount, status, updated_at FROM orders WHERE status=$1 ORDER BY updated_at", status,
 	)
 	if err != nil {
-		log.Printf("[ERROR] cannot get orders %v", err)
+		slog.ErrorContext(ctx, "cannot get orders", "err", err)
 		return orders, err
 	}
 	defer rows.Close()
@@ -347,7 +480,7 @@ func (p *Storage) GetOrdersByStatus(ctx context.Context, status models.AccrualSt
 		order := models.OrderResponse{}
 		err := rows.Scan(&order.ID, &order.Amount, &order.Status, &order.UploadedAt)
 		if err != nil {
-			log.Printf("[ERROR] cannot get order %v", err)
+			slog.ErrorContext(ctx, "cannot get order", "err", err)
 			continue
 		}
 		orders = append(orders, order)
@@ -0,0 +1,105 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+func (p *Storage) CreateSession(ctx context.Context, session models.Session) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(
+		ctx,
+		"INSERT INTO sessions (id, uid, refresh_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		session.ID,
+		session.UID,
+		session.RefreshHash,
+		session.ExpiresAt,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot create session", "uid", session.UID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// RotateSession swaps the refresh token of a live session for a new one.
+// Presenting an already rotated token means it leaked, the whole session is
+// revoked then and ErrTokenRevoked returned.
+func (p *Storage) RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (models.Session, error) {
+	var session models.Session
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(
+		ctx,
+		`UPDATE sessions SET previous_hash=refresh_hash, refresh_hash=$2, expires_at=$3
+		WHERE refresh_hash=$1 AND revoked_at IS NULL AND expires_at > now()
+		RETURNING id, uid, expires_at`,
+		oldHash, newHash, expiresAt,
+	).Scan(&session.ID, &session.UID, &session.ExpiresAt)
+	if err == nil {
+		session.RefreshHash = newHash
+		return session, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		slog.ErrorContext(ctx, "cannot rotate session", "err", err)
+		return session, err
+	}
+
+	err = p.db.QueryRow(
+		ctx,
+		"UPDATE sessions SET revoked_at=now() WHERE previous_hash=$1 AND revoked_at IS NULL RETURNING id, uid",
+		oldHash,
+	).Scan(&session.ID, &session.UID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return session, models.ErrTokenInvalid
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot revoke session", "err", err)
+		return session, err
+	}
+
+	slog.WarnContext(ctx, "refresh token reused, session revoked", "sid", session.ID)
+	return session, models.ErrTokenRevoked
+}
+
+func (p *Storage) RevokeSession(ctx context.Context, sid uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(ctx, "UPDATE sessions SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL", sid)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot revoke session", "sid", sid, "err", err)
+		return err
+	}
+	return nil
+}
+
+// IsSessionRevoked tells whether tokens of the session must be rejected,
+// unknown sessions count as revoked
+func (p *Storage) IsSessionRevoked(ctx context.Context, sid uuid.UUID) (bool, error) {
+	var revoked bool
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(ctx, "SELECT revoked_at IS NOT NULL FROM sessions WHERE id=$1", sid).Scan(&revoked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get session", "sid", sid, "err", err)
+		return false, err
+	}
+	return revoked, nil
+}
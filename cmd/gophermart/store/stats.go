@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// Stats counts queued accrual jobs, orders by status and withdrawals
+func (p *Storage) Stats(ctx context.Context) (models.Stats, error) {
+	stats := models.Stats{
+		QueueDepth: make(map[models.AccrualJobStage]int),
+		Orders:     make(map[models.AccrualStatus]int),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	rows, err := p.db.Query(ctx, "SELECT stage, count(*) FROM accrual_jobs GROUP BY stage")
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot count accrual jobs", "err", err)
+		return stats, err
+	}
+	for rows.Next() {
+		var stage models.AccrualJobStage
+		var n int
+		if err := rows.Scan(&stage, &n); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		stats.QueueDepth[stage] = n
+	}
+	rows.Close()
+
+	rows, err = p.db.Query(ctx, "SELECT status, count(*) FROM orders WHERE NOT deleted GROUP BY status")
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot count orders", "err", err)
+		return stats, err
+	}
+	for rows.Next() {
+		var status models.AccrualStatus
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		stats.Orders[status] = n
+	}
+	rows.Close()
+
+	err = p.db.QueryRow(ctx, "SELECT count(*), COALESCE(SUM(amount), 0)::bigint FROM withdrawals").Scan(&stats.Withdrawals, &stats.Withdrawn)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot count withdrawals", "err", err)
+		return stats, err
+	}
+	return stats, nil
+}
+
+// PoolStats reports the connection pool usage
+func (p *Storage) PoolStats() models.PoolStats {
+	stat := p.db.Stat()
+	return models.PoolStats{
+		Acquired:      stat.AcquiredConns(),
+		Idle:          stat.IdleConns(),
+		Total:         stat.TotalConns(),
+		Max:           stat.MaxConns(),
+		EmptyAcquires: stat.EmptyAcquireCount(),
+	}
+}
@@ -0,0 +1,174 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// GetTOTP returns the second factor of the user, zero TOTP if there is none
+func (p *Storage) GetTOTP(ctx context.Context, uid uuid.UUID) (models.TOTP, error) {
+	totp := models.TOTP{UID: uid}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	err := p.db.QueryRow(
+		ctx,
+		"SELECT secret, enabled, last_step FROM user_totp WHERE uid=$1",
+		uid,
+	).Scan(&totp.Secret, &totp.Enabled, &totp.LastStep)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return totp, nil
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot get totp", "uid", uid, "err", err)
+		return totp, err
+	}
+	return totp, nil
+}
+
+// SaveTOTPSecret stores a pending secret, an enabled second factor is not replaced
+func (p *Storage) SaveTOTPSecret(ctx context.Context, uid uuid.UUID, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tag, err := p.db.Exec(
+		ctx,
+		`INSERT INTO user_totp (uid, secret) VALUES ($1, $2)
+		ON CONFLICT (uid) DO UPDATE SET secret=EXCLUDED.secret, last_step=0 WHERE NOT user_totp.enabled`,
+		uid, secret,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot save totp secret", "uid", uid, "err", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrTOTPEnabled
+	}
+	return nil
+}
+
+// ListTOTPSecrets returns the second factors of all users, pending ones included
+func (p *Storage) ListTOTPSecrets(ctx context.Context) ([]models.TOTP, error) {
+	secrets := []models.TOTP{}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	rows, err := p.db.Query(ctx, "SELECT uid, secret, enabled, last_step FROM user_totp")
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot list totp secrets", "err", err)
+		return secrets, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var totp models.TOTP
+		if err := rows.Scan(&totp.UID, &totp.Secret, &totp.Enabled, &totp.LastStep); err != nil {
+			return secrets, err
+		}
+		secrets = append(secrets, totp)
+	}
+	return secrets, rows.Err()
+}
+
+// ReplaceTOTPSecret swaps the stored secret if it is still old, a secret
+// enrolled again in the meantime is kept
+func (p *Storage) ReplaceTOTPSecret(ctx context.Context, uid uuid.UUID, old, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	_, err := p.db.Exec(ctx, "UPDATE user_totp SET secret=$3 WHERE uid=$1 AND secret=$2", uid, old, secret)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot replace totp secret", "uid", uid, "err", err)
+		return err
+	}
+	return nil
+}
+
+// EnableTOTP turns the pending second factor on and replaces the recovery codes
+func (p *Storage) EnableTOTP(ctx context.Context, uid uuid.UUID, step int64, recoveryHashes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(
+		ctx,
+		"UPDATE user_totp SET enabled=true, last_step=$2 WHERE uid=$1 AND NOT enabled",
+		uid, step,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot enable totp", "uid", uid, "err", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrTOTPEnabled
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM recovery_codes WHERE uid=$1", uid)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot drop recovery codes", "uid", uid, "err", err)
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		_, err = tx.Exec(ctx, "INSERT INTO recovery_codes (uid, code_hash) VALUES ($1, $2)", uid, hash)
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot save recovery code", "uid", uid, "err", err)
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UseTOTPStep accepts a code of the step once, older or replayed steps get ErrTOTPCodeInvalid
+func (p *Storage) UseTOTPStep(ctx context.Context, uid uuid.UUID, step int64) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tag, err := p.db.Exec(
+		ctx,
+		"UPDATE user_totp SET last_step=$2 WHERE uid=$1 AND enabled AND last_step < $2",
+		uid, step,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot use totp step", "uid", uid, "err", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrTOTPCodeInvalid
+	}
+	return nil
+}
+
+// UseRecoveryCode spends a recovery code, unknown or used ones get ErrTOTPCodeInvalid
+func (p *Storage) UseRecoveryCode(ctx context.Context, uid uuid.UUID, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tag, err := p.db.Exec(
+		ctx,
+		"UPDATE recovery_codes SET used_at=now() WHERE uid=$1 AND code_hash=$2 AND used_at IS NULL",
+		uid, hash,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot use recovery code", "uid", uid, "err", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrTOTPCodeInvalid
+	}
+	return nil
+}
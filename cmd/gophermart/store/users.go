@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stsg/gophermart/cmd/gophermart/models"
+)
+
+// DeleteUser soft deletes the user with their orders and withdrawals, drops
+// pending accrual jobs and revokes the sessions, their ids are returned
+func (p *Storage) DeleteUser(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE users SET deleted=true, deleted_at=now() WHERE uid=$1 AND NOT deleted", uid)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot delete user", "uid", uid, "err", err)
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, models.ErrUserNotFound
+	}
+
+	for _, query := range []string{
+		"UPDATE orders SET deleted=true WHERE uid=$1",
+		"UPDATE withdrawals SET deleted=true WHERE uid=$1",
+		"DELETE FROM accrual_jobs WHERE uid=$1",
+	} {
+		_, err = tx.Exec(ctx, query, uid)
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot delete user data", "uid", uid, "err", err)
+			return nil, err
+		}
+	}
+
+	sids, err := revokeUserSessions(ctx, tx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return sids, tx.Commit(ctx)
+}
+
+// AnonymizeUsers replaces login and password of users deleted before the moment and
+// drops their credentials, orders and ledger stay for accounting. The number of
+// anonymized users is returned.
+func (p *Storage) AnonymizeUsers(ctx context.Context, deletedBefore time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.QueryTimeout)
+	defer cancel()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot begin tx", "err", err)
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(
+		ctx,
+		`UPDATE users SET login='deleted-' || uid::text, password='', jwt=NULL, anonymized_at=now()
+		WHERE deleted AND anonymized_at IS NULL AND deleted_at < $1
+		RETURNING uid`,
+		deletedBefore,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot anonymize users", "err", err)
+		return 0, err
+	}
+	var uids []uuid.UUID
+	for rows.Next() {
+		var uid uuid.UUID
+		if err := rows.Scan(&uid); err != nil {
+			slog.ErrorContext(ctx, "cannot scan", "err", err)
+			continue
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE uid = ANY($1)",
+		"DELETE FROM password_resets WHERE uid = ANY($1)",
+		"DELETE FROM recovery_codes WHERE uid = ANY($1)",
+		"DELETE FROM user_totp WHERE uid = ANY($1)",
+	} {
+		_, err = tx.Exec(ctx, query, uids)
+		if err != nil {
+			slog.ErrorContext(ctx, "cannot drop credentials of anonymized users", "err", err)
+			return 0, err
+		}
+	}
+
+	return len(uids), tx.Commit(ctx)
+}